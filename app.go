@@ -19,33 +19,34 @@ import (
 	"runtime"
 	"strconv"
 	"time"
+	"unicode/utf8"
 	imagepkg "image"
-	"image/png"
-	"image/jpeg"
+	_ "image/gif"
 	"github.com/oliamb/cutter"
-	"github.com/nfnt/resize"
 
 	_ "net/http/pprof"
-	"bytes"
 )
 
 const (
 	listenAddr = ":5000"
 
-	timeout  = 30
-	interval = 2
+	timeout = 30
 
-	iconS  = 32
-	iconM  = 64
-	iconL  = 128
-	imageS = 128
-	imageM = 256
-	imageL = -1
+	maxCaptionLength = 1000
+	maxEntryImages   = 10
+
+	defaultLimit = 30
+	maxLimit     = 100
+
+	defaultStaticDir = "/home/isucon/static"
 )
 
 var (
 	dbConn  *sql.DB
 	config  *Config
+	dataStore   BlobStore
+	staticStore BlobStore
+	timelineHub = newHub()
 	exp3 = regexp.MustCompile("^[a-zA-Z0-9_]{2,16}$")
 )
 
@@ -57,14 +58,30 @@ type Config struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	} `json:"database"`
-	Datadir string `json:"data_dir"`
+	Datadir   string `json:"data_dir"`
+	Staticdir string `json:"static_dir"`
+	Storage   string `json:"storage"`
+	IconPresets  []Preset `json:"icon_presets"`
+	ImagePresets []Preset `json:"image_presets"`
+	// ImageSecret は任意の大きさの画像 URL に付ける署名の鍵。空なら任意の大きさは使えない
+	ImageSecret string `json:"image_secret"`
+	// KeepExif が false なら、アップロードされた画像から位置情報などのメタデータ (Exif, XMP, IPTC) を取り除く
+	KeepExif bool `json:"keep_exif"`
+	// RenderWorkers と RenderQueue は画像を作る worker の数とキューの長さ。0 なら CPU 数とその 4 倍
+	RenderWorkers int `json:"render_workers"`
+	RenderQueue   int `json:"render_queue"`
+	// VariantCacheBytes は作った画像をメモリに持つ量。0 なら 64MiB
+	VariantCacheBytes int64 `json:"variant_cache_bytes"`
+	// VariantUrlsPerMinute は 1 人が 1 分間に発行できる任意の大きさの画像 URL の数。0 なら 60
+	VariantUrlsPerMinute int `json:"variant_urls_per_minute"`
 }
 
 type User struct {
-	Id     int
-	Name   string
-	Apikey string
-	Icon   string
+	Id      int
+	Name    string
+	Apikey  string
+	Icon    string
+	Private bool
 }
 
 type Entry struct {
@@ -73,6 +90,7 @@ type Entry struct {
 	Image        string
 	PublishLevel int
 	CreatedAt    string
+	Caption      string
 }
 
 type FollowMap struct {
@@ -117,7 +135,7 @@ func getUser(r *http.Request) (*User, error) {
 	err := dbConn.QueryRow(
 		"SELECT * FROM users WHERE api_key = ?", apiKey,
 	).Scan(
-		&user.Id, &user.Name, &user.Apikey, &user.Icon,
+		&user.Id, &user.Name, &user.Apikey, &user.Icon, &user.Private,
 	)
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -127,6 +145,97 @@ func getUser(r *http.Request) (*User, error) {
 	return &user, nil
 }
 
+func getUserById(id int) (User, error) {
+	user := User{}
+	err := dbConn.QueryRow(
+		"SELECT * FROM users WHERE id = ?", id,
+	).Scan(
+		&user.Id, &user.Name, &user.Apikey, &user.Icon, &user.Private,
+	)
+	return user, err
+}
+
+func getEntryById(id interface{}) (Entry, error) {
+	entry := Entry{}
+	err := dbConn.QueryRow(
+		"SELECT * FROM entries WHERE id = ?", id,
+	).Scan(
+		&entry.Id, &entry.User, &entry.Image, &entry.PublishLevel, &entry.CreatedAt, &entry.Caption,
+	)
+	return entry, err
+}
+
+// getEntryByImage は entry に含まれるどれかの画像から entry を引く。
+func getEntryByImage(image string) (Entry, error) {
+	entry := Entry{}
+	err := dbConn.QueryRow(
+		"SELECT entries.* FROM entry_images JOIN entries ON (entry_images.entry = entries.id) WHERE entry_images.image = ?", image,
+	).Scan(
+		&entry.Id, &entry.User, &entry.Image, &entry.PublishLevel, &entry.CreatedAt, &entry.Caption,
+	)
+	if err != sql.ErrNoRows {
+		return entry, err
+	}
+	// entry_images ができる前の entry は entries.image だけを持つ
+	err = dbConn.QueryRow(
+		"SELECT * FROM entries WHERE image = ?", image,
+	).Scan(
+		&entry.Id, &entry.User, &entry.Image, &entry.PublishLevel, &entry.CreatedAt, &entry.Caption,
+	)
+	return entry, err
+}
+
+// getEntryImages は entry の画像を投稿された順に返す。
+func getEntryImages(entry Entry) ([]string, error) {
+	rows, err := dbConn.Query(
+		"SELECT image FROM entry_images WHERE entry = ? ORDER BY position", entry.Id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	images := []string{}
+	for rows.Next() {
+		var image string
+		rows.Scan(&image)
+		images = append(images, image)
+	}
+	if len(images) == 0 {
+		images = append(images, entry.Image)
+	}
+	return images, rows.Err()
+}
+
+// parsePublishLevel は publish_level が 0, 1, 2 のいずれかであることを確かめる。
+func parsePublishLevel(s string) (int, bool) {
+	level, err := strconv.Atoi(s)
+	if err != nil || level < 0 || 2 < level {
+		return 0, false
+	}
+	return level, true
+}
+
+func validCaption(caption string) bool {
+	return utf8.ValidString(caption) && utf8.RuneCountInString(caption) <= maxCaptionLength
+}
+
+// inserted は INSERT IGNORE で実際に行が増えたかを返す。
+func inserted(result sql.Result) bool {
+	n, err := result.RowsAffected()
+	return err == nil && 0 < n
+}
+
+func scanEntries(rows *sql.Rows) ([]Entry, error) {
+	defer rows.Close()
+	entries := []Entry{}
+	for rows.Next() {
+		entry := Entry{}
+		rows.Scan(&entry.Id, &entry.User, &entry.Image, &entry.PublishLevel, &entry.CreatedAt, &entry.Caption)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
 func loadConfig(filename string) *Config {
 	log.Printf("loading config file: %s", filename)
 	f, err := ioutil.ReadFile(filename)
@@ -140,25 +249,44 @@ func loadConfig(filename string) *Config {
 		log.Fatal(err)
 		os.Exit(1)
 	}
+	if err := validatePresets(config.IconPresets); err != nil {
+		log.Fatal("icon_presets: ", err)
+	}
+	if err := validatePresets(config.ImagePresets); err != nil {
+		log.Fatal("image_presets: ", err)
+	}
 	return &config
 }
 
+func openStores(config *Config) {
+	staticDir := config.Staticdir
+	if staticDir == "" {
+		staticDir = defaultStaticDir
+	}
+	dataStore = newBlobStore(config.Storage, config.Datadir)
+	staticStore = newBlobStore(config.Storage, staticDir)
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	rand.Seed(time.Now().Unix())
 
-	cnvrt := os.Getenv("CONVERT")
-	if cnvrt != "" {
-		Convertfile()
-		return
-	}
-
 	env := os.Getenv("ISUCON_ENV")
 	if env == "" {
 		env = "local"
 	}
 	config = loadConfig("../config/" + env + ".json")
+	openStores(config)
+	openRenderPool(config)
+	openVariantCache(config)
+	openVariantUrlLimiter(config)
+
+	cnvrt := os.Getenv("CONVERT")
+	if cnvrt != "" {
+		Convertfile()
+		return
+	}
 
 	db := config.Database
 	connectionString := fmt.Sprintf(
@@ -175,15 +303,37 @@ func main() {
 	r := mux.NewRouter()
 	r.HandleFunc("/signup", signupHandler).Methods("POST")
 	r.HandleFunc("/me", meHandler).Methods("GET")
-	r.HandleFunc("/entry/{id}", deleteEntryHandler).Methods("POST")
+	r.HandleFunc("/me/private", updatePrivateHandler).Methods("POST")
+	r.HandleFunc("/entry/{id}", entryMethodHandler).Methods("POST")
+	r.HandleFunc("/entry/{id}", updateEntryHandler).Methods("PUT", "PATCH")
+	r.HandleFunc("/entry/{id}/like", likeHandler).Methods("POST", "DELETE")
+	r.HandleFunc("/entry/{id}/comments", commentsHandler).Methods("GET")
+	r.HandleFunc("/entry/{id}/comments", postCommentHandler).Methods("POST")
+	r.HandleFunc("/entry/{id}/comments/{comment}", deleteCommentHandler).Methods("POST", "DELETE")
 	r.HandleFunc("/entry", entryHandler).Methods("POST")
 	r.HandleFunc("/timeline", timelineHandler).Methods("GET")
+	r.HandleFunc("/timeline/stream", timelineStreamHandler).Methods("GET")
+	r.HandleFunc("/timeline/ws", timelineWebSocketHandler).Methods("GET")
+	r.HandleFunc("/user/{id}/entries", userEntriesHandler).Methods("GET")
 	r.HandleFunc("/icon/{icon}", iconHandler).Methods("GET")
 	r.HandleFunc("/icon", updateIconHandler).Methods("POST")
 	r.HandleFunc("/image/{image}", imageHandler).Methods("GET")
+	r.HandleFunc("/image/{image}/variant", variantUrlHandler).Methods("GET")
 	r.HandleFunc("/follow", followingHandler).Methods("GET")
+	r.HandleFunc("/followers", followersHandler).Methods("GET")
+	r.HandleFunc("/user/{id}/{kind:following|followers}", userFollowsHandler).Methods("GET")
 	r.HandleFunc("/follow", followHandler).Methods("POST")
 	r.HandleFunc("/unfollow", unfollowHandler).Methods("POST")
+	r.HandleFunc("/follow_requests", followRequestsHandler).Methods("GET")
+	r.HandleFunc("/follow_requests/{id}/{action:approve|reject}", answerFollowRequestHandler).Methods("POST")
+	r.HandleFunc("/notifications", notificationsHandler).Methods("GET")
+	r.HandleFunc("/notifications/read", readNotificationsHandler).Methods("POST")
+	r.HandleFunc("/block", relationHandler("blocks")).Methods("GET")
+	r.HandleFunc("/block", updateRelationHandler("blocks", true)).Methods("POST")
+	r.HandleFunc("/unblock", updateRelationHandler("blocks", false)).Methods("POST")
+	r.HandleFunc("/mute", relationHandler("mutes")).Methods("GET")
+	r.HandleFunc("/mute", updateRelationHandler("mutes", true)).Methods("POST")
+	r.HandleFunc("/unmute", updateRelationHandler("mutes", false)).Methods("POST")
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
 	http.Handle("/", r)
 	http.ListenAndServe(listenAddr, nil)
@@ -200,6 +350,11 @@ func notFound(w http.ResponseWriter) {
 	http.Error(w, http.StatusText(code), code)
 }
 
+func forbidden(w http.ResponseWriter) {
+	code := http.StatusForbidden
+	http.Error(w, http.StatusText(code), code)
+}
+
 func badRequest(w http.ResponseWriter) {
 	code := http.StatusBadRequest
 	http.Error(w, http.StatusText(code), code)
@@ -220,37 +375,8 @@ func sha256Hex(a ...interface{}) string {
 	return hex.EncodeToString(md)
 }
 
-func convert(data []byte, ext string, w int, h int) ([]byte, error) {
-	image, _, err := imagepkg.Decode(bytes.NewReader(data))
-	if err != nil {
-		log.Println("Cannot decode")
-		return nil, err
-	}
-	resized := resize.Resize(uint(w), uint(h), image, resize.Lanczos3)
-	b := []byte{}
-	buf := bytes.NewBuffer(b)
-	if ext == "jpg" {
-		err := jpeg.Encode(buf, resized, nil)
-		if err != nil {
-			log.Println("Failed encoding jpg")
-			return nil, err
-		}
-	} else if ext == "png" {
-		err := png.Encode(buf, resized)
-		if err != nil {
-			log.Println("Failed encoding png")
-			return nil, err
-		}
-	} else {
-		log.Println("Unexpected ext " + ext)
-		return nil, err
-	}
-	log.Println("Converted size is ", len(buf.Bytes()))
-
-	return buf.Bytes(), nil
-}
-
-func cropSquare(image imagepkg.Image, ext string) ([]byte, error) {
+// cropSquare は画像の中央を正方形に切り抜く。エンコードはしない。
+func cropSquare(image imagepkg.Image) (imagepkg.Image, error) {
 	w := image.Bounds().Size().X
 	h := image.Bounds().Size().Y
 	var crop_x float32
@@ -271,25 +397,43 @@ func cropSquare(image imagepkg.Image, ext string) ([]byte, error) {
 	}
 
 	log.Println("Crop width:", pixels, "height:", pixels, "anchor x:", int(crop_x), "anchor y:", int(crop_y))
-	cropped, err := cutter.Crop(image, cutter.Config{Width: pixels, Height: pixels, Anchor: imagepkg.Pt(int(crop_x), int(crop_y))})
+	return cutter.Crop(image, cutter.Config{Width: pixels, Height: pixels, Anchor: imagepkg.Pt(int(crop_x), int(crop_y))})
+}
+
+// entryResponse は owner が投稿した entry を viewer に返す形にする。
+// viewer が nil のときは未ログインとして扱う。
+func entryResponse(baseUrl *url.URL, entry Entry, owner User, viewer *User) (Response, error) {
+	likeCount, likedByMe, err := getLikeStats(entry.Id, viewer)
 	if err != nil {
 		return nil, err
 	}
-	b := []byte{}
-	buf := bytes.NewBuffer(b)
-	if ext == "jpg" {
-		err := jpeg.Encode(buf, cropped, nil)
-		if err != nil {
-			return nil, err
-		}
-	} else if ext == "png" {
-		err := png.Encode(buf, cropped)
-		if err != nil {
-			return nil, err
+	imageIds, err := getEntryImages(entry)
+	if err != nil {
+		return nil, err
+	}
+	images := []Response{}
+	for _, imageId := range imageIds {
+		imageUrl := baseUrl.String() + "/image/" + imageId
+		sizes := Response{}
+		for _, preset := range imagePresets() {
+			sizes[preset.Name] = imageUrl + "?size=" + url.QueryEscape(preset.Name)
 		}
+		images = append(images, sizes)
 	}
-
-	return buf.Bytes(), nil
+	return Response{
+		"id":            entry.Id,
+		"image":         baseUrl.String() + "/image/" + entry.Image,
+		"images":        images,
+		"publish_level": entry.PublishLevel,
+		"caption":       entry.Caption,
+		"like_count":    likeCount,
+		"liked_by_me":   likedByMe,
+		"user": Response{
+			"id":   owner.Id,
+			"name": owner.Name,
+			"icon": baseUrl.String() + "/icon/" + owner.Icon,
+		},
+	}, nil
 }
 
 func renderJson(w http.ResponseWriter, r Response) {
@@ -329,7 +473,7 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 	err = dbConn.QueryRow(
 		"SELECT * FROM users WHERE id = ?", id,
 	).Scan(
-		&user.Id, &user.Name, &user.Apikey, &user.Icon,
+		&user.Id, &user.Name, &user.Apikey, &user.Icon, &user.Private,
 	)
 	if err != nil {
 		serverError(w, err)
@@ -358,9 +502,10 @@ func meHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	renderJson(w, Response{
-		"id":   user.Id,
-		"name": user.Name,
-		"icon": baseUrl.String() + "/icon/" + user.Icon,
+		"id":      user.Id,
+		"name":    user.Name,
+		"icon":    baseUrl.String() + "/icon/" + user.Icon,
+		"private": user.Private,
 	})
 }
 
@@ -377,72 +522,181 @@ func entryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	uploadFile, handler, err := r.FormFile("image")
-	if err != nil {
-		serverError(w, err)
+	limitUploadBody(w, r, maxEntryImages)
+	if e := parseUploadForm(r); e != nil {
+		renderUploadError(w, e)
 		return
 	}
-	if handler == nil {
-		badRequest(w)
+	// image は複数指定でき、指定された順に 1 つの entry にまとめる
+	handlers := r.MultipartForm.File["image"]
+	if len(handlers) == 0 || maxEntryImages < len(handlers) {
+		renderUploadError(w, &UploadError{http.StatusBadRequest, "invalid_image_count", fmt.Sprintf("1 to %d images are required", maxEntryImages)})
 		return
 	}
 
-	contentType := handler.Header.Get("Content-Type")
-	if !(contentType == "image/jpeg" || contentType == "image/jpg") {
+	publishLevel, ok := parsePublishLevel(r.FormValue("publish_level"))
+	if !ok {
+		badRequest(w)
+		return
+	}
+	caption := r.FormValue("caption")
+	if !validCaption(caption) {
 		badRequest(w)
 		return
 	}
 
-	data, err := ioutil.ReadAll(uploadFile)
+	// 1 枚でも不正な画像があれば何も保存しない
+	uploads := [][]byte{}
+	formats := []string{}
+	for _, handler := range handlers {
+		data, ext, _, err := readUpload(handler, "jpg", "png", "gif", "webp")
+		if err != nil {
+			uploadFailed(w, err)
+			return
+		}
+		if !config.KeepExif {
+			data = stripMetadata(data, ext)
+		}
+		uploads = append(uploads, data)
+		formats = append(formats, ext)
+	}
+
+	// 元の形式のまま保存する
+	imageIds := []string{}
+	for i, data := range uploads {
+		imageId := sha256Hex(uuid.NewUUID())
+		err = dataStore.Put("image/"+imageId+"."+formats[i], data)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		imageIds = append(imageIds, imageId)
+	}
+
+	// entries.image には互換のため先頭の画像を入れておく
+	result, err := dbConn.Exec(
+		"INSERT INTO entries (user, image, publish_level, created_at, caption) VALUES (?, ?, ?, NOW(), ?)",
+		user.Id, imageIds[0], publishLevel, caption,
+	)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
 
-	imageId := sha256Hex(uuid.NewUUID())
-	err = ioutil.WriteFile(config.Datadir+"/image/"+imageId+".jpg", data, 0666)
+	id, err := result.LastInsertId()
 	if err != nil {
 		serverError(w, err)
 		return
 	}
 
-	publishLevel := r.FormValue("publish_level")
-	result, err := dbConn.Exec(
-		"INSERT INTO entries (user, image, publish_level, created_at) VALUES (?, ?, ?, NOW())",
-		user.Id, imageId, publishLevel,
-	)
+	for i, imageId := range imageIds {
+		_, err = dbConn.Exec(
+			"INSERT INTO entry_images (entry, image, position, format) VALUES (?, ?, ?, ?)",
+			id, imageId, i, formats[i],
+		)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	entry, err := getEntryById(id)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
 
-	id, err := result.LastInsertId()
+	// 縮小画像を裏で作っておき、最初に見た人を待たせない
+	prerenderImages(imageIds, formats)
+	timelineHub.Publish(Event{Type: "entry", Entry: entry})
+
+	res, err := entryResponse(baseUrl, entry, *user, user)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
+	if err := withVariants(r, res, entry); err != nil {
+		serverError(w, err)
+		return
+	}
+	renderJson(w, res)
+}
 
-	entry := Entry{}
-	err = dbConn.QueryRow(
-		"SELECT * FROM entries WHERE id = ?", id,
-	).Scan(
-		&entry.Id, &entry.User, &entry.Image, &entry.PublishLevel, &entry.CreatedAt,
+// parseLimit は limit パラメータを読み、1 から maxLimit の範囲に収める。
+func parseLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		return defaultLimit
+	}
+	if maxLimit < limit {
+		return maxLimit
+	}
+	return limit
+}
+
+// nextCursor は entries の続きがありそうなら最も古い entry の id を返す。
+func nextCursor(entries []Entry, limit int) interface{} {
+	if len(entries) < limit {
+		return nil
+	}
+	return entries[len(entries)-1].Id
+}
+
+// queryTimeline は latestEntryId より新しい entry か、before より古い entry を
+// 新しい順に limit 件まで返す。
+func queryTimeline(user *User, latestEntryId int, before int, limit int) ([]Entry, error) {
+	var (
+		rows *sql.Rows
+		err  error
 	)
+	visible, args := policy.EntriesSQL(user, "entries")
+	// ミュートしたユーザーの entry はタイムラインに出さない
+	visible = "(" + visible + " AND entries.user NOT IN (SELECT target FROM mutes WHERE user=?))"
+	args = append(args, user.Id)
+	if 0 < before {
+		rows, err = dbConn.Query(
+			"SELECT * FROM entries WHERE "+visible+" AND id < ? ORDER BY id DESC LIMIT ?",
+			append(args, before, limit)...,
+		)
+	} else if 0 < latestEntryId {
+		rows, err = dbConn.Query(
+			"SELECT * FROM (SELECT * FROM entries WHERE "+visible+" AND id > ? ORDER BY id LIMIT ?) AS e ORDER BY e.id DESC",
+			append(args, latestEntryId, limit)...,
+		)
+	} else {
+		rows, err = dbConn.Query(
+			"SELECT * FROM entries WHERE "+visible+" ORDER BY id DESC LIMIT ?",
+			append(args, limit)...,
+		)
+	}
 	if err != nil {
-		serverError(w, err)
-		return
+		return nil, err
 	}
+	return scanEntries(rows)
+}
 
-	renderJson(w, Response{
-		"id":            entry.Id,
-		"image":         baseUrl.String() + "/image/" + entry.Image,
-		"publish_level": entry.PublishLevel,
-		"user": Response{
-			"id":   user.Id,
-			"name": user.Name,
-			"icon": baseUrl.String() + "/icon/" + user.Icon,
-		},
-	})
+// waitVisibleEntry は user に見える entry が publish されるまで待つ。
+// timeout かクライアントの切断で false を返す。
+func waitVisibleEntry(user *User, sub *Subscription, timeoutMessage <-chan time.Time, done <-chan struct{}) (bool, error) {
+	for {
+		select {
+		case ev := <-sub.C:
+			if ev.Type != "entry" {
+				continue
+			}
+			ok, err := visibleOnTimeline(user, ev.Entry)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		case <-timeoutMessage:
+			return false, nil
+		case <-done:
+			return false, nil
+		}
+	}
 }
 
 func timelineHandler(w http.ResponseWriter, r *http.Request) {
@@ -462,164 +716,185 @@ func timelineHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		latestEntryId = 0
 	}
+	before, err := strconv.Atoi(r.FormValue("before"))
+	if err != nil {
+		before = 0
+	}
+	limit := parseLimit(r)
 
-	timeoutMessage := make(chan bool)
-	entriesMessage := make(chan []Response)
-
-	go func() {
-		time.Sleep(time.Second * timeout)
-		timeoutMessage <- true
-	}()
+	// 問い合わせ中に投稿された entry を取りこぼさないよう先に購読しておく
+	sub := timelineHub.Subscribe()
+	defer sub.Close()
+	timeoutMessage := time.After(time.Second * timeout)
 
-	go func() {
-		for {
-			var (
-				rows *sql.Rows
-				err  error
-			)
-			if 0 < latestEntryId {
-				rows, err = dbConn.Query(
-					"SELECT * FROM (SELECT * FROM entries WHERE (user=? OR publish_level=2 OR (publish_level=1 AND user IN (SELECT target FROM follow_map WHERE user=?))) AND id > ? ORDER BY id LIMIT 30) AS e ORDER BY e.id DESC",
-					user.Id, user.Id, latestEntryId,
-				)
-			} else {
-				rows, err = dbConn.Query(
-					"SELECT * FROM entries WHERE (user=? OR publish_level=2 OR (publish_level=1 AND user IN (SELECT target FROM follow_map WHERE user=?))) ORDER BY id DESC LIMIT 30",
-					user.Id, user.Id,
-				)
-			}
-			if err != nil {
-				serverError(w, err)
-				return
+	for {
+		entries, err := queryTimeline(user, latestEntryId, before, limit)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		// 過去を遡るときは待たずに返す
+		if 0 < len(entries) || 0 < before {
+			res := []Response{}
+			for _, entry := range entries {
+				owner, err := getUserById(entry.User)
+				if err != nil {
+					serverError(w, err)
+					return
+				}
+				e, err := entryResponse(baseUrl, entry, owner, user)
+				if err != nil {
+					serverError(w, err)
+					return
+				}
+				if err := withVariants(r, e, entry); err != nil {
+					serverError(w, err)
+					return
+				}
+				res = append(res, e)
 			}
-			entries := []Entry{}
-			for rows.Next() {
-				entry := Entry{}
-				rows.Scan(&entry.Id, &entry.User, &entry.Image, &entry.PublishLevel, &entry.CreatedAt)
-				entries = append(entries, entry)
+			var cursor interface{}
+			if 0 < before || latestEntryId == 0 {
+				cursor = nextCursor(entries, limit)
 			}
-			rows.Close()
-			if 0 < len(entries) {
-				res := []Response{}
-				for _, entry := range entries {
-					user := User{}
-					err = dbConn.QueryRow(
-						"SELECT * FROM users WHERE id = ?", entry.User,
-					).Scan(
-						&user.Id, &user.Name, &user.Apikey, &user.Icon,
-					)
-					if err != nil {
-						serverError(w, err)
-						return
-					}
-					res = append(res, Response{
-						"id":            entry.Id,
-						"image":         baseUrl.String() + "/image/" + entry.Image,
-						"publish_level": entry.PublishLevel,
-						"user": Response{
-							"id":   user.Id,
-							"name": user.Name,
-							"icon": baseUrl.String() + "/icon/" + user.Icon,
-						},
-					})
-				}
+			if 0 < len(entries) && before == 0 {
 				latestEntryId = entries[0].Id
-				entriesMessage <- res
-				return
 			}
-			time.Sleep(time.Second * interval)
+			renderJsonNoCache(w, Response{
+				"latest_entry": latestEntryId,
+				"next_cursor":  cursor,
+				"entries":      res,
+			})
+			return
 		}
-	}()
 
-	select {
-	case entries := <-entriesMessage:
-		renderJsonNoCache(w, Response{
-			"latest_entry": latestEntryId,
-			"entries":      entries,
-		})
-		return
-	case <-timeoutMessage:
-		renderJsonNoCache(w, Response{
-			"latest_entry": latestEntryId,
-			"entries":      []Entry{},
-		})
-		return
+		ok, err := waitVisibleEntry(user, sub, timeoutMessage, r.Context().Done())
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		if !ok {
+			renderJsonNoCache(w, Response{
+				"latest_entry": latestEntryId,
+				"next_cursor":  nil,
+				"entries":      []Entry{},
+			})
+			return
+		}
 	}
 }
 
-func iconHandler(w http.ResponseWriter, r *http.Request) {
-	prepareHandler(w, r)
+func userEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
 
-	vars := mux.Vars(r)
-	icon := vars["icon"]
+	viewer, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 
-	if _, err := os.Stat(config.Datadir + "/icon/" + icon + ".png"); os.IsNotExist(err) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		notFound(w)
+		return
+	}
+	owner, err := getUserById(id)
+	if err == sql.ErrNoRows {
 		notFound(w)
 		return
+	} else if err != nil {
+		serverError(w, err)
+		return
 	}
 
-	size := r.FormValue("size")
-	if size == "" {
-		size = "s"
+	before, err := strconv.Atoi(r.FormValue("before"))
+	if err != nil {
+		before = 0
 	}
+	limit := parseLimit(r)
 
-	var width int
-	var height int
-	if size == "s" {
-		width = iconS
-	} else if size == "m" {
-		width = iconM
-	} else if size == "l" {
-		width = iconL
+	visible, args := policy.EntriesSQL(viewer, "entries")
+	args = append([]interface{}{owner.Id}, args...)
+	var rows *sql.Rows
+	if 0 < before {
+		rows, err = dbConn.Query(
+			"SELECT * FROM entries WHERE user=? AND "+visible+" AND id < ? ORDER BY id DESC LIMIT ?",
+			append(args, before, limit)...,
+		)
 	} else {
-		width = iconS
+		rows, err = dbConn.Query(
+			"SELECT * FROM entries WHERE user=? AND "+visible+" ORDER BY id DESC LIMIT ?",
+			append(args, limit)...,
+		)
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	entries, err := scanEntries(rows)
+	if err != nil {
+		serverError(w, err)
+		return
 	}
-	height = width
-
-	filename := "/home/isucon/static/icon/" + size + "/" + icon + ".png"
-	var data []byte
 
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		file, err := os.Open(config.Datadir+"/icon/"+icon+".png")
+	res := []Response{}
+	for _, entry := range entries {
+		e, err := entryResponse(baseUrl, entry, owner, viewer)
 		if err != nil {
 			serverError(w, err)
 			return
 		}
-		defer file.Close()
-
-		b, err := ioutil.ReadAll(file)
-		if err != nil {
+		if err := withVariants(r, e, entry); err != nil {
 			serverError(w, err)
 			return
 		}
+		res = append(res, e)
+	}
+	renderJsonNoCache(w, Response{
+		"user": Response{
+			"id":   owner.Id,
+			"name": owner.Name,
+			"icon": baseUrl.String() + "/icon/" + owner.Icon,
+		},
+		"next_cursor": nextCursor(entries, limit),
+		"entries":     res,
+	})
+}
 
-		data, err = convert(b, "png", width, height)
-		if err != nil {
-			serverError(w, err)
-			return
-		}
+func iconHandler(w http.ResponseWriter, r *http.Request) {
+	prepareHandler(w, r)
 
-		log.Println("Save icon to", filename)
-		data_copy := data[:]
-		err = ioutil.WriteFile(filename, data_copy, 0777)
-		if err != nil {
-			serverError(w, err)
-			return
-		}
+	vars := mux.Vars(r)
+	icon := vars["icon"]
+
+	info, err := dataStore.Stat("icon/" + icon + ".png")
+	if err == ErrBlobNotFound {
+		notFound(w)
+		return
 	} else if err != nil {
-		log.Println("Unexpected error")
 		serverError(w, err)
 		return
-	} else {
-		log.Println("Load icon from", filename)
-		data, err = ioutil.ReadFile(filename)
-		if err != nil {
-			serverError(w, err)
-			return
-		}
 	}
-	w.Header().Set("Content-Type", "image/png")
-	w.Write(data)
+
+	preset := findPreset(iconPresets(), r.FormValue("size"), "s")
+	ext := preset.Format
+	if ext == "" {
+		w.Header().Set("Vary", "Accept")
+		ext = negotiateFormat(r.Header.Get("Accept"), "png", !preset.Resized())
+	}
+
+	key := presetKey("icon", icon, preset, ext)
+	if variantNotModified(w, r, key, info.ModTime, iconCacheControl) {
+		return
+	}
+	data, err := loadOrRender(key, func() ([]byte, error) {
+		return renderIcon(icon, preset, ext)
+	})
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	serveVariant(w, r, key, data, info.ModTime)
 }
 
 func imageHandler(w http.ResponseWriter, r *http.Request) {
@@ -634,12 +909,7 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	image := vars["image"]
 
-	entry := Entry{}
-	err = dbConn.QueryRow(
-		"SELECT * FROM entries WHERE image = ?", image,
-	).Scan(
-		&entry.Id, &entry.User, &entry.Image, &entry.PublishLevel, &entry.CreatedAt,
-	)
+	entry, err := getEntryByImage(image)
 	if err == sql.ErrNoRows {
 		notFound(w)
 		return
@@ -648,113 +918,62 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if entry.PublishLevel == 0 {
-		// publish_level == 0 はentryの所有者しか見えない
-		if user != nil && entry.User == user.Id {
-			// ok
-		} else {
-			notFound(w)
-			return
-		}
-	} else if entry.PublishLevel == 1 {
-		// publish_level == 1 はentryの所有者かfollowerしか見えない
-		if user != nil && entry.User == user.Id {
-			// ok
-		} else if user != nil {
-			followMap := FollowMap{}
-			err = dbConn.QueryRow(
-				"SELECT user, target, created_at FROM follow_map WHERE user = ? AND target = ?",
-				user.Id, entry.User,
-			).Scan(
-				&followMap.User, &followMap.Target, &followMap.CreatedAt,
-			)
-			if err == sql.ErrNoRows {
-				notFound(w)
-				return
-			} else if err != nil {
-				serverError(w, err)
-				return
-			}
-		} else {
-			notFound(w)
-			return
-		}
+	if ok, err := policy.CanView(user, entry); err != nil {
+		serverError(w, err)
+		return
+	} else if !ok {
+		notFound(w)
+		return
 	}
 
-	size := r.FormValue("size")
-	if size == "" {
-		size = "l"
-	}
+	preset := findPreset(imagePresets(), r.FormValue("size"), "l")
 
-	var width, height int
-	if size == "s" {
-		width = imageS
-	} else if size == "m" {
-		width = imageM
-	} else if size == "l" {
-		width = imageL
-	} else {
-		width = imageL
+	// w, h が指定されていれば署名付きの任意の大きさを返す
+	variant, err := parseVariant(r, image)
+	if err == errVariantSignature {
+		forbidden(w)
+		return
+	} else if err != nil {
+		badRequest(w)
+		return
 	}
-	log.Println("size: " + size)
-
-	filename := "/home/isucon/static/image/" + size + "/" + image + ".jpg"
-	var data []byte
-
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		var data []byte
-		if 0 <= width {
-			file, err := os.Open(config.Datadir+"/image/"+image+".jpg")
-			if err != nil {
-				serverError(w, err)
-				return
-			}
-			defer file.Close()
 
-			image, _, err := imagepkg.Decode(file)
-			data2, err := cropSquare(image, "jpg")
-			if err != nil {
-				serverError(w, err)
-				return
-			}
-			b, err := convert(data2, "jpg", width, height)
-			if err != nil {
-				serverError(w, err)
-				return
-			}
-			data = b
-		} else {
-			b, err := ioutil.ReadFile(config.Datadir + "/image/" + image + ".jpg")
-			if err != nil {
-				serverError(w, err)
-				return
-			}
-			data = b
-		}
+	format, err := getImageFormat(image)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	ext := preset.Format
+	if variant != nil || ext == "" {
+		// 元の大きさならエンコードできない形式 (webp) でもそのまま返せる
+		ext = negotiateFormat(r.Header.Get("Accept"), format, variant == nil && !preset.Resized())
+	}
 
-		log.Println("Save image to", filename)
-		data_copy := data[:]
-		err := ioutil.WriteFile(filename, data_copy, 0777)
-		if err != nil {
-			log.Println("Failed to write file", filename)
-			serverError(w, err)
-			return
-		}
-	} else if err != nil {
-		log.Println("Unexpected err")
+	info, err := dataStore.Stat("image/" + image + "." + format)
+	if err != nil {
 		serverError(w, err)
 		return
-	} else {
-		log.Println("Load image from", filename)
-		data, err = ioutil.ReadFile(filename)
-		if err != nil {
-			serverError(w, err)
-			return
-		}
 	}
 
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.Write(data)
+	key := presetKey("image", image, preset, ext)
+	if variant != nil {
+		key = VariantKey{Kind: "image", Id: image, Size: variant.Name(), Ext: ext}
+	}
+	log.Println("size: " + key.Size)
+
+	// 再検証なら画像を作らずに 304 を返す
+	w.Header().Set("Vary", "Accept")
+	if variantNotModified(w, r, key, info.ModTime, imageCacheControl(entry)) {
+		return
+	}
+	data, err := loadOrRender(key, func() ([]byte, error) {
+		return renderImage(image, format, preset, variant, ext)
+	})
+	if err != nil {
+		renderFailed(w, err)
+		return
+	}
+	serveVariant(w, r, key, data, info.ModTime)
 }
 
 func deleteEntryHandler(w http.ResponseWriter, r *http.Request) {
@@ -774,12 +993,7 @@ func deleteEntryHandler(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 	method := r.FormValue("__method")
 
-	entry := Entry{}
-	err = dbConn.QueryRow(
-		"SELECT * FROM entries WHERE id = ?", id,
-	).Scan(
-		&entry.Id, &entry.User, &entry.Image, &entry.PublishLevel, &entry.CreatedAt,
-	)
+	entry, err := getEntryById(id)
 	if err == sql.ErrNoRows {
 		notFound(w)
 		return
@@ -793,37 +1007,182 @@ func deleteEntryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	images, err := getEntryImages(entry)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
 	_, err = dbConn.Exec("DELETE FROM entries WHERE id = ?", entry.Id)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
+	_, err = dbConn.Exec("DELETE FROM entry_images WHERE entry = ?", entry.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	_, err = dbConn.Exec("DELETE FROM likes WHERE entry = ?", entry.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	_, err = dbConn.Exec("DELETE FROM comments WHERE entry = ?", entry.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	_, err = dbConn.Exec("DELETE FROM notifications WHERE entry = ?", entry.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	for _, image := range images {
+		variantCache.Invalidate("image", image)
+	}
+	timelineHub.Publish(Event{Type: "delete", Entry: entry})
 
 	renderJson(w, Response{"ok": true})
 }
 
-func getFollowing(w http.ResponseWriter, user *User, baseUrl *url.URL) {
-	rows, err := dbConn.Query(
-		"SELECT users.* FROM follow_map JOIN users ON (follow_map.target = users.id) WHERE follow_map.user = ? ORDER BY follow_map.created_at DESC",
-		user.Id,
+// entryMethodHandler は POST /entry/{id} を __method で振り分ける。
+func entryMethodHandler(w http.ResponseWriter, r *http.Request) {
+	method := r.FormValue("__method")
+	if method == "PUT" || method == "PATCH" {
+		updateEntryHandler(w, r)
+	} else {
+		deleteEntryHandler(w, r)
+	}
+}
+
+// updateEntryHandler は所有者による caption と publish_level の変更を受け付ける。
+// フォームに含まれない項目は変更しない。
+func updateEntryHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	// multipart でも urlencoded でも r.Form に入るようにする
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		badRequest(w)
+		return
+	}
+
+	entry, err := getEntryById(mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user.Id != entry.User {
+		badRequest(w)
+		return
+	}
+
+	if _, ok := r.Form["caption"]; ok {
+		entry.Caption = r.FormValue("caption")
+		if !validCaption(entry.Caption) {
+			badRequest(w)
+			return
+		}
+	}
+	if _, ok := r.Form["publish_level"]; ok {
+		entry.PublishLevel, ok = parsePublishLevel(r.FormValue("publish_level"))
+		if !ok {
+			badRequest(w)
+			return
+		}
+	}
+
+	_, err = dbConn.Exec(
+		"UPDATE entries SET caption = ?, publish_level = ? WHERE id = ?",
+		entry.Caption, entry.PublishLevel, entry.Id,
 	)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
+
+	timelineHub.Publish(Event{Type: "update", Entry: entry})
+
+	res, err := entryResponse(baseUrl, entry, *user, user)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	renderJson(w, res)
+}
+
+// renderFollows は follow_map を created_at の新しい順にたどって描画する。
+// followers が false なら userId が follow している人、true なら userId を follow している人。
+// mutual は userId とそのユーザーが互いに follow しているかどうか。
+// limit が 0 なら全件を返す。
+func renderFollows(w http.ResponseWriter, baseUrl *url.URL, userId int, followers bool, limit int, offset int) {
+	var query string
+	if followers {
+		query = "SELECT users.id, users.name, users.api_key, users.icon, EXISTS(SELECT 1 FROM follow_map AS f WHERE f.user = follow_map.target AND f.target = follow_map.user) FROM follow_map JOIN users ON (follow_map.user = users.id) WHERE follow_map.target = ? ORDER BY follow_map.created_at DESC"
+	} else {
+		query = "SELECT users.id, users.name, users.api_key, users.icon, EXISTS(SELECT 1 FROM follow_map AS f WHERE f.user = follow_map.target AND f.target = follow_map.user) FROM follow_map JOIN users ON (follow_map.target = users.id) WHERE follow_map.user = ? ORDER BY follow_map.created_at DESC"
+	}
+	args := []interface{}{userId}
+	if 0 < limit {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 	res := []Response{}
 	for rows.Next() {
 		u := User{}
-		rows.Scan(&u.Id, &u.Name, &u.Apikey, &u.Icon)
+		var mutual bool
+		rows.Scan(&u.Id, &u.Name, &u.Apikey, &u.Icon, &mutual)
 		res = append(res, Response{
-			"id":   u.Id,
-			"name": u.Name,
-			"icon": baseUrl.String() + "/icon/" + u.Icon,
+			"id":     u.Id,
+			"name":   u.Name,
+			"icon":   baseUrl.String() + "/icon/" + u.Icon,
+			"mutual": mutual,
 		})
 	}
 	rows.Close()
 
-	renderJsonNoCache(w, Response{"users": res})
+	var nextOffset interface{}
+	if 0 < limit && len(res) == limit {
+		nextOffset = offset + limit
+	}
+	renderJsonNoCache(w, Response{"users": res, "next_offset": nextOffset})
+}
+
+func getFollowing(w http.ResponseWriter, user *User, baseUrl *url.URL) {
+	renderFollows(w, baseUrl, user.Id, false, 0, 0)
+}
+
+// parsePage は limit と offset を読む。limit が指定されなければ 0 (全件) を返す。
+func parsePage(r *http.Request) (int, int) {
+	limit := 0
+	if r.FormValue("limit") != "" {
+		limit = parseLimit(r)
+	}
+	offset, err := strconv.Atoi(r.FormValue("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
 }
 
 func followingHandler(w http.ResponseWriter, r *http.Request) {
@@ -839,7 +1198,63 @@ func followingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	getFollowing(w, user, baseUrl)
+	limit, offset := parsePage(r)
+	renderFollows(w, baseUrl, user.Id, false, limit, offset)
+}
+
+func followersHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	limit, offset := parsePage(r)
+	renderFollows(w, baseUrl, user.Id, true, limit, offset)
+}
+
+func userFollowsHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		notFound(w)
+		return
+	}
+	owner, err := getUserById(id)
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if ok, err := policy.CanViewFollows(user, owner); err != nil {
+		serverError(w, err)
+		return
+	} else if !ok {
+		notFound(w)
+		return
+	}
+
+	limit, offset := parsePage(r)
+	if limit == 0 {
+		limit = defaultLimit
+	}
+	renderFollows(w, baseUrl, id, vars["kind"] == "followers", limit, offset)
 }
 
 func followHandler(w http.ResponseWriter, r *http.Request) {
@@ -865,14 +1280,53 @@ func followHandler(w http.ResponseWriter, r *http.Request) {
 		if user.Id == target {
 			continue
 		}
-		_, err := dbConn.Exec(
-			"INSERT IGNORE INTO follow_map (user, target, created_at) VALUES (?, ?, NOW())",
-			user.Id, target,
-		)
+		// ブロックされている相手は follow できない
+		blocked, err := policy.Relations.Blocks(target, user.Id)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		if blocked {
+			continue
+		}
+		targetUser, err := getUserById(target)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			serverError(w, err)
+			return
+		}
+		// すでに follow しているなら何もしない (非公開でもリクエストは作らない)
+		following, err := policy.Relations.Follows(user.Id, target)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		if following {
+			continue
+		}
+		var result sql.Result
+		kind := notifyFollow
+		if targetUser.Private {
+			// 非公開アカウントには承認されるまでリクエストとして保留する
+			kind = notifyFollowRequest
+			result, err = dbConn.Exec(
+				"INSERT IGNORE INTO follow_requests (user, target, created_at) VALUES (?, ?, NOW())",
+				user.Id, target,
+			)
+		} else {
+			result, err = dbConn.Exec(
+				"INSERT IGNORE INTO follow_map (user, target, created_at) VALUES (?, ?, NOW())",
+				user.Id, target,
+			)
+		}
 		if err != nil {
 			serverError(w, err)
 			return
 		}
+		if inserted(result) {
+			notify(Notification{User: target, Kind: kind, Actor: user.Id})
+		}
 	}
 
 	getFollowing(w, user, baseUrl)
@@ -908,6 +1362,14 @@ func unfollowHandler(w http.ResponseWriter, r *http.Request) {
 			serverError(w, err)
 			return
 		}
+		_, err = dbConn.Exec(
+			"DELETE FROM follow_requests WHERE user = ? AND target = ?",
+			user.Id, target,
+		)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
 	}
 
 	getFollowing(w, user, baseUrl)
@@ -926,35 +1388,37 @@ func updateIconHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	uploadFile, handler, err := r.FormFile("image")
-	if err != nil {
-		serverError(w, err)
+	limitUploadBody(w, r, 1)
+	if e := parseUploadForm(r); e != nil {
+		renderUploadError(w, e)
 		return
 	}
-	if handler == nil {
-		badRequest(w)
+	handlers := r.MultipartForm.File["image"]
+	if len(handlers) != 1 {
+		renderUploadError(w, &UploadError{http.StatusBadRequest, "invalid_image_count", "exactly one image is required"})
 		return
 	}
 
-	contentType := handler.Header.Get("Content-Type")
-	if !(contentType == "image/jpeg" || contentType == "image/jpg" || contentType == "image/png") {
-		badRequest(w)
-		return
-	}
-
-	image, _, err := imagepkg.Decode(uploadFile)
+	data, _, image, err := readUpload(handlers[0], "jpg", "png")
 	if err != nil {
-		serverError(w, err)
+		uploadFailed(w, err)
 		return
 	}
-	data2, err := cropSquare(image, "png")
+	// 中央の正方形の切り抜きは向きによらないので、切り抜いた後の小さい画像を回す
+	data2, err := renderPool.Do(func() ([]byte, error) {
+		cropped, err := cropSquare(image)
+		if err != nil {
+			return nil, err
+		}
+		return encodeImage(applyOrientation(cropped, jpegOrientation(data)), "png", EncodeOptions{})
+	})
 	if err != nil {
-		serverError(w, err)
+		renderFailed(w, err)
 		return
 	}
 
 	iconId := sha256Hex(uuid.NewUUID())
-	err = ioutil.WriteFile(config.Datadir+"/icon/"+iconId+".png", data2, 0666)
+	err = dataStore.Put("icon/"+iconId+".png", data2)
 	if err != nil {
 		serverError(w, err)
 		return
@@ -968,6 +1432,7 @@ func updateIconHandler(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
+	variantCache.Invalidate("icon", user.Icon)
 
 	renderJson(w, Response{"icon": baseUrl.String() + "/icon/" + iconId})
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+func isMuted(user, target int) (bool, error) {
+	return exists("SELECT 1 FROM mutes WHERE user = ? AND target = ?", user, target)
+}
+
+// visibleOnTimeline は entry を user のタイムラインに流してよいかを返す。
+// 見える entry のうち、ミュートしたユーザーのものは流さない。
+func visibleOnTimeline(user *User, entry Entry) (bool, error) {
+	ok, err := policy.CanView(user, entry)
+	if err != nil || !ok {
+		return false, err
+	}
+	if entry.User == user.Id {
+		return true, nil
+	}
+	muted, err := isMuted(user.Id, entry.User)
+	if err != nil {
+		return false, err
+	}
+	return !muted, nil
+}
+
+// renderRelation は blocks や mutes で user が対象にしているユーザーを描画する。
+func renderRelation(w http.ResponseWriter, baseUrl *url.URL, table string, user *User) {
+	rows, err := dbConn.Query(
+		"SELECT users.id, users.name, users.api_key, users.icon FROM "+table+" JOIN users ON ("+table+".target = users.id) WHERE "+table+".user = ? ORDER BY "+table+".created_at DESC",
+		user.Id,
+	)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	res := []Response{}
+	for rows.Next() {
+		u := User{}
+		rows.Scan(&u.Id, &u.Name, &u.Apikey, &u.Icon)
+		res = append(res, Response{
+			"id":   u.Id,
+			"name": u.Name,
+			"icon": baseUrl.String() + "/icon/" + u.Icon,
+		})
+	}
+	rows.Close()
+
+	renderJsonNoCache(w, Response{"users": res})
+}
+
+// relationHandler は GET /block, GET /mute を扱う。
+func relationHandler(table string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		baseUrl := prepareHandler(w, r)
+
+		user, err := getUser(r)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		if user == nil {
+			badRequest(w)
+			return
+		}
+
+		renderRelation(w, baseUrl, table, user)
+	}
+}
+
+// updateRelationHandler は POST /block, /unblock, /mute, /unmute を扱う。
+// followHandler と同じく target を複数受け取れる。
+func updateRelationHandler(table string, add bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		baseUrl := prepareHandler(w, r)
+
+		user, err := getUser(r)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		if user == nil {
+			badRequest(w)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			serverError(w, err)
+			return
+		}
+
+		for _, targetStr := range r.Form["target"] {
+			target, _ := strconv.Atoi(targetStr)
+			if user.Id == target {
+				continue
+			}
+			if add {
+				_, err = dbConn.Exec(
+					"INSERT IGNORE INTO "+table+" (user, target, created_at) VALUES (?, ?, NOW())",
+					user.Id, target,
+				)
+			} else {
+				_, err = dbConn.Exec(
+					"DELETE FROM "+table+" WHERE user = ? AND target = ?",
+					user.Id, target,
+				)
+			}
+			if err != nil {
+				serverError(w, err)
+				return
+			}
+			if add && table == "blocks" {
+				// ブロックしたら互いの follow とリクエストを解除する
+				_, err = dbConn.Exec(
+					"DELETE FROM follow_map WHERE (user = ? AND target = ?) OR (user = ? AND target = ?)",
+					target, user.Id, user.Id, target,
+				)
+				if err != nil {
+					serverError(w, err)
+					return
+				}
+				_, err = dbConn.Exec(
+					"DELETE FROM follow_requests WHERE (user = ? AND target = ?) OR (user = ? AND target = ?)",
+					target, user.Id, user.Id, target,
+				)
+				if err != nil {
+					serverError(w, err)
+					return
+				}
+			}
+		}
+
+		renderRelation(w, baseUrl, table, user)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+)
+
+const defaultVariantCacheBytes = 64 << 20
+
+// variantCacheItemShare は 1 つの画像が使ってよいキャッシュの割合の逆数。
+// 元の大きさの原本のような大きなものでキャッシュ全体が入れ替わらないようにする。
+const variantCacheItemShare = 16
+
+// VariantKey は作った画像の識別子。Kind は "icon" か "image"、
+// Size は preset 名か Variant の Name、Ext は出力形式。
+// Version は preset の設定のハッシュで、設定を変えると別の画像として扱われる。
+type VariantKey struct {
+	Kind    string
+	Id      string
+	Size    string
+	Version string
+	Ext     string
+}
+
+// Path は staticStore に保存するときの key。
+func (k VariantKey) Path() string {
+	if k.Version == "" {
+		return k.Kind + "/" + k.Size + "/" + k.Id + "." + k.Ext
+	}
+	return k.Kind + "/" + k.Size + "/" + k.Version + "/" + k.Id + "." + k.Ext
+}
+
+// ETag は key の画像の強い ETag。同じ key の中身は変わらない。
+func (k VariantKey) ETag() string {
+	if k.Version == "" {
+		return `"` + k.Kind + "-" + k.Id + "-" + k.Size + "." + k.Ext + `"`
+	}
+	return `"` + k.Kind + "-" + k.Id + "-" + k.Size + "-" + k.Version + "." + k.Ext + `"`
+}
+
+type cacheItem struct {
+	key  VariantKey
+	data []byte
+}
+
+// VariantCache は作った画像をメモリに持つ LRU キャッシュ。
+// 合計の大きさが maxBytes を超えたら古く使われたものから捨てる。
+// maxItemBytes より大きいものは入れない。
+type VariantCache struct {
+	mu           sync.Mutex
+	maxBytes     int64
+	maxItemBytes int64
+	bytes        int64
+	order        *list.List
+	items        map[VariantKey]*list.Element
+	// byId は Invalidate のための (Kind, Id) ごとの索引
+	byId      map[[2]string]map[VariantKey]struct{}
+	hits      int64
+	misses    int64
+	evictions int64
+	skipped   int64
+}
+
+var variantCache *VariantCache
+
+func newVariantCache(maxBytes int64) *VariantCache {
+	return &VariantCache{
+		maxBytes:     maxBytes,
+		maxItemBytes: maxBytes / variantCacheItemShare,
+		order:        list.New(),
+		items:        map[VariantKey]*list.Element{},
+		byId:         map[[2]string]map[VariantKey]struct{}{},
+	}
+}
+
+func (c *VariantCache) Get(key VariantKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheItem).data, true
+}
+
+// Has は key が入っているかを返す。Get と違い、使われたことにはしない。
+func (c *VariantCache) Has(key VariantKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.items[key]
+	return ok
+}
+
+// Add は data を入れる。maxItemBytes より大きいものは入れない。
+func (c *VariantCache) Add(key VariantKey, data []byte) {
+	size := int64(len(data))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.maxItemBytes < size {
+		c.skipped++
+		return
+	}
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	c.items[key] = c.order.PushFront(&cacheItem{key: key, data: data})
+	id := [2]string{key.Kind, key.Id}
+	if c.byId[id] == nil {
+		c.byId[id] = map[VariantKey]struct{}{}
+	}
+	c.byId[id][key] = struct{}{}
+	c.bytes += size
+	for c.maxBytes < c.bytes {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+}
+
+// Invalidate は kind の id から作った画像をすべて捨てる。
+func (c *VariantCache) Invalidate(kind string, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.byId[[2]string{kind, id}] {
+		c.remove(c.items[key])
+	}
+}
+
+func (c *VariantCache) remove(e *list.Element) {
+	item := e.Value.(*cacheItem)
+	c.order.Remove(e)
+	delete(c.items, item.key)
+	id := [2]string{item.key.Kind, item.key.Id}
+	delete(c.byId[id], item.key)
+	if len(c.byId[id]) == 0 {
+		delete(c.byId, id)
+	}
+	c.bytes -= int64(len(item.data))
+}
+
+func (c *VariantCache) Stats() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]int64{
+		"max_bytes":      c.maxBytes,
+		"max_item_bytes": c.maxItemBytes,
+		"bytes":          c.bytes,
+		"items":          int64(len(c.items)),
+		"hits":           c.hits,
+		"misses":         c.misses,
+		"evictions":      c.evictions,
+		"skipped":        c.skipped,
+	}
+}
+
+// openVariantCache は config から variantCache を作り、/debug/vars に統計を出す。
+func openVariantCache(config *Config) {
+	maxBytes := config.VariantCacheBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultVariantCacheBytes
+	}
+	variantCache = newVariantCache(maxBytes)
+	expvar.Publish("variant_cache", expvar.Func(func() interface{} {
+		return variantCache.Stats()
+	}))
+}
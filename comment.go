@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const maxCommentLength = 1000
+
+// Comment は entry へのコメント。返信は 1 段だけで、返信への返信も
+// 元のコメントにぶら下げる。Parent が 0 なら entry への直接のコメント。
+type Comment struct {
+	Id        int
+	Entry     int
+	User      int
+	Parent    int
+	Body      string
+	CreatedAt string
+}
+
+func getCommentById(id interface{}) (Comment, error) {
+	comment := Comment{}
+	err := dbConn.QueryRow(
+		"SELECT id, entry, user, parent, body, created_at FROM comments WHERE id = ?", id,
+	).Scan(
+		&comment.Id, &comment.Entry, &comment.User, &comment.Parent, &comment.Body, &comment.CreatedAt,
+	)
+	return comment, err
+}
+
+func commentResponse(baseUrl *url.URL, comment Comment, user User) Response {
+	var parent interface{}
+	if 0 < comment.Parent {
+		parent = comment.Parent
+	}
+	return Response{
+		"id":         comment.Id,
+		"entry":      comment.Entry,
+		"parent_id":  parent,
+		"body":       comment.Body,
+		"created_at": comment.CreatedAt,
+		"user": Response{
+			"id":   user.Id,
+			"name": user.Name,
+			"icon": baseUrl.String() + "/icon/" + user.Icon,
+		},
+	}
+}
+
+// getVisibleEntry は user に見える entry だけを返す。見えなければ sql.ErrNoRows。
+func getVisibleEntry(user *User, id string) (Entry, error) {
+	entry, err := getEntryById(id)
+	if err != nil {
+		return entry, err
+	}
+	ok, err := policy.CanView(user, entry)
+	if err != nil {
+		return entry, err
+	} else if !ok {
+		return entry, sql.ErrNoRows
+	}
+	return entry, nil
+}
+
+// commentsHandler はコメントを古い順に返す。after に前回の next_cursor を渡すと続きを返す。
+func commentsHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	entry, err := getVisibleEntry(user, mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	after, err := strconv.Atoi(r.FormValue("after"))
+	if err != nil {
+		after = 0
+	}
+	limit := parseLimit(r)
+
+	rows, err := dbConn.Query(
+		"SELECT id, entry, user, parent, body, created_at FROM comments WHERE entry = ? AND id > ? ORDER BY id LIMIT ?",
+		entry.Id, after, limit,
+	)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	comments := []Comment{}
+	for rows.Next() {
+		comment := Comment{}
+		rows.Scan(&comment.Id, &comment.Entry, &comment.User, &comment.Parent, &comment.Body, &comment.CreatedAt)
+		comments = append(comments, comment)
+	}
+	rows.Close()
+
+	res := []Response{}
+	for _, comment := range comments {
+		author, err := getUserById(comment.User)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		res = append(res, commentResponse(baseUrl, comment, author))
+	}
+
+	var cursor interface{}
+	if len(comments) == limit {
+		cursor = comments[len(comments)-1].Id
+	}
+	renderJsonNoCache(w, Response{
+		"next_cursor": cursor,
+		"comments":    res,
+	})
+}
+
+func postCommentHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	entry, err := getVisibleEntry(user, mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	body := r.FormValue("body")
+	if body == "" || !utf8.ValidString(body) || maxCommentLength < utf8.RuneCountInString(body) {
+		badRequest(w)
+		return
+	}
+
+	parentId := 0
+	parentUser := 0
+	if s := r.FormValue("parent_id"); s != "" {
+		parent, err := getCommentById(s)
+		if err == sql.ErrNoRows || (err == nil && parent.Entry != entry.Id) {
+			badRequest(w)
+			return
+		} else if err != nil {
+			serverError(w, err)
+			return
+		}
+		parentId = parent.Id
+		parentUser = parent.User
+		if 0 < parent.Parent {
+			parentId = parent.Parent
+		}
+	}
+
+	result, err := dbConn.Exec(
+		"INSERT INTO comments (entry, user, parent, body, created_at) VALUES (?, ?, ?, ?, NOW())",
+		entry.Id, user.Id, parentId, body,
+	)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	comment, err := getCommentById(id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	notify(Notification{User: entry.User, Kind: notifyComment, Actor: user.Id, Entry: entry.Id, Comment: comment.Id})
+	if 0 < parentUser && parentUser != entry.User {
+		notify(Notification{User: parentUser, Kind: notifyComment, Actor: user.Id, Entry: entry.Id, Comment: comment.Id})
+	}
+
+	renderJson(w, commentResponse(baseUrl, comment, *user))
+}
+
+// deleteCommentHandler はコメントの投稿者か entry の所有者だけが削除できる。
+// 返信もまとめて削除する。
+func deleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	vars := mux.Vars(r)
+	if r.Method != "DELETE" && r.FormValue("__method") != "DELETE" {
+		badRequest(w)
+		return
+	}
+
+	entry, err := getVisibleEntry(user, vars["id"])
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	comment, err := getCommentById(vars["comment"])
+	if err == sql.ErrNoRows || (err == nil && comment.Entry != entry.Id) {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	if user.Id != comment.User && user.Id != entry.User {
+		badRequest(w)
+		return
+	}
+
+	// 消えたコメントを指す通知も消す
+	_, err = dbConn.Exec(
+		"DELETE FROM notifications WHERE comment IN (SELECT id FROM comments WHERE id = ? OR parent = ?)",
+		comment.Id, comment.Id,
+	)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	_, err = dbConn.Exec(
+		"DELETE FROM comments WHERE id = ? OR parent = ?",
+		comment.Id, comment.Id,
+	)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	renderJson(w, Response{"ok": true})
+}
@@ -1,81 +1,48 @@
 package main
 
 import (
-	"io/ioutil"
-	"os"
 	"log"
 	"path/filepath"
-	imagepkg "image"
+	"strings"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"sync"
 )
 
 func Convertfile(){
-	dir := "./data/image/"
-	paths, err := ioutil.ReadDir(dir)
+	keys, err := dataStore.List("image/")
 	if err != nil {
 		return
 	}
-	ch := make(chan int, 100)
 	var wg sync.WaitGroup
 
-	for _, path := range paths {
-		for _, size := range []string{"s", "m", "l"} {
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, "image/")
+		format := strings.TrimPrefix(filepath.Ext(name), ".")
+		for _, preset := range imagePresets() {
+			ext := presetExt(preset, format)
 			wg.Add(1)
-			ch <- 0
-			go func(path os.FileInfo, size string) {
-				var width, height int
-				if size == "s" {
-					width = imageS
-				} else if size == "m" {
-					width = imageM
-				} else if size == "l" {
-					width = imageL
-				} else {
-					width = imageL
-				}
-
-				filename := "/home/isucon/static/image/" + size + "/" + path.Name()
+			name, ext, preset := name, ext, preset
+			renderPool.Submit(func() {
+				defer wg.Done()
 
-				if _, err := os.Stat(filename); os.IsNotExist(err) {
-					var data []byte
-					if 0 <= width {
-						file, err := os.Open(filepath.Join(dir, path.Name()))
-						if err != nil {
-							log.Println("failed to open", err)
-							return
-						}
+				filename := presetKey("image", strings.TrimSuffix(name, filepath.Ext(name)), preset, ext).Path()
 
-						image, _, err := imagepkg.Decode(file)
-						if err != nil {
-							log.Println("Failed to Decode", err)
-							return
-						}
-						data, err := cropSquare(image, "jpg")
-						if err != nil {
-							log.Println("Failed to crop", err)
-							return
-						}
-						b, err := convert(data, "jpg", width, height)
-						if err != nil {
-							log.Println("Failed to convert", err)
-							return
-						}
-						data = b
-						file.Close()
-					} else {
-						b, err := ioutil.ReadFile(filepath.Join(dir, path.Name()))
-						if err != nil {
-							log.Println("failed to read file", err)
-							return
-						}
-						data = b
+				if _, err := staticStore.Stat(filename); err == ErrBlobNotFound {
+					original, err := dataStore.Get("image/" + name)
+					if err != nil {
+						log.Println("failed to read file", err)
+						return
+					}
+					data, err := renderPreset(original, format, preset, ext)
+					if err != nil {
+						log.Println("Failed to convert", err)
+						return
 					}
 
 					log.Println("Save image to", filename)
-					data_copy := data[:]
-					err := ioutil.WriteFile(filename, data_copy, 0777)
+					err = staticStore.Put(filename, data)
 					if err != nil {
 						log.Println("Failed to write file", filename, err)
 						return
@@ -84,10 +51,8 @@ func Convertfile(){
 					log.Println("Unexpected err", err)
 					return
 				}
-				<- ch
-				wg.Done()
-			}(path, size)
+			})
 		}
 	}
 	wg.Wait()
-}
\ No newline at end of file
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	imagepkg "image"
+	"image/draw"
+)
+
+const (
+	jpegSOS           = 0xda
+	jpegAPP0          = 0xe0
+	jpegAPP1          = 0xe1
+	jpegAPP13         = 0xed
+	exifOrientationId = 0x0112
+)
+
+var (
+	exifHeader         = []byte("Exif\x00\x00")
+	xmpHeader          = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtensionHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+// jpegSegment は SOS より前にある 1 つのセグメント。
+// data はマーカーと長さを含むセグメント全体、payload は長さの後ろの中身。
+type jpegSegment struct {
+	marker  byte
+	data    []byte
+	payload []byte
+}
+
+// splitJpeg は JPEG を SOS より前のセグメントと、SOS 以降の残りに分ける。
+func splitJpeg(data []byte) ([]jpegSegment, []byte, bool) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, nil, false
+	}
+	segments := []jpegSegment{}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return nil, nil, false
+		}
+		// マーカーの前の 0xff は詰め物なので読み飛ばす
+		for i+1 < len(data) && data[i+1] == 0xff {
+			i++
+		}
+		if i+4 > len(data) {
+			break
+		}
+		marker := data[i+1]
+		if marker == jpegSOS {
+			return segments, data[i:], true
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, nil, false
+		}
+		segments = append(segments, jpegSegment{
+			marker:  marker,
+			data:    data[i : i+2+length],
+			payload: data[i+4 : i+2+length],
+		})
+		i += 2 + length
+	}
+	return nil, nil, false
+}
+
+func isExifSegment(s jpegSegment) bool {
+	return s.marker == jpegAPP1 && bytes.HasPrefix(s.payload, exifHeader)
+}
+
+// isMetadataSegment は位置情報などを含みうるセグメントかを返す。
+// Exif と XMP (APP1) と IPTC (APP13) が該当する。
+func isMetadataSegment(s jpegSegment) bool {
+	if isExifSegment(s) || s.marker == jpegAPP13 {
+		return true
+	}
+	return s.marker == jpegAPP1 && (bytes.HasPrefix(s.payload, xmpHeader) || bytes.HasPrefix(s.payload, xmpExtensionHeader))
+}
+
+// exifOrientation は Exif の IFD0 にある Orientation (1 から 8) を返す。
+// 無いか読めなければ 1 (回転なし)。
+func exifOrientation(payload []byte) int {
+	tiff := payload[len(exifHeader):]
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	if tiff[0] == 'I' && tiff[1] == 'I' {
+		order = binary.LittleEndian
+	} else if tiff[0] == 'M' && tiff[1] == 'M' {
+		order = binary.BigEndian
+	} else {
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == exifOrientationId {
+			orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if orientation < 1 || 8 < orientation {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// jpegOrientation は JPEG の Exif から Orientation を読む。JPEG でなければ 1。
+func jpegOrientation(data []byte) int {
+	segments, _, ok := splitJpeg(data)
+	if !ok {
+		return 1
+	}
+	for _, s := range segments {
+		if isExifSegment(s) {
+			return exifOrientation(s.payload)
+		}
+	}
+	return 1
+}
+
+// orientationSegment は Orientation だけを持つ最小の Exif セグメントを作る。
+func orientationSegment(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08,
+		0x00, 0x01,
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, byte(orientation), 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+	payload := append(append([]byte{}, exifHeader...), tiff...)
+	segment := []byte{0xff, jpegAPP1, 0x00, 0x00}
+	binary.BigEndian.PutUint16(segment[2:4], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// stripMetadata はアップロードされた画像から位置情報やカメラの情報を含む
+// メタデータを取り除く。ext は sniffImage で判定した拡張子。
+func stripMetadata(data []byte, ext string) []byte {
+	switch ext {
+	case "jpg":
+		return stripExif(data)
+	case "png":
+		return stripPngMetadata(data)
+	case "webp":
+		return stripWebpMetadata(data)
+	}
+	return data
+}
+
+// stripExif は JPEG から Exif, XMP, IPTC を取り除く。
+// 表示が変わらないよう Orientation だけは残す。JPEG でなければそのまま返す。
+func stripExif(data []byte) []byte {
+	segments, rest, ok := splitJpeg(data)
+	if !ok {
+		return data
+	}
+	orientation := 1
+	kept := []jpegSegment{}
+	for _, s := range segments {
+		if isExifSegment(s) {
+			orientation = exifOrientation(s.payload)
+		} else if !isMetadataSegment(s) {
+			kept = append(kept, s)
+		}
+	}
+
+	buf := bytes.NewBuffer([]byte{0xff, 0xd8})
+	for i, s := range kept {
+		// Exif は JFIF (APP0) があればその直後、なければ先頭に置く
+		if i == 0 && s.marker == jpegAPP0 {
+			buf.Write(s.data)
+			continue
+		}
+		if orientation != 1 {
+			buf.Write(orientationSegment(orientation))
+			orientation = 1
+		}
+		buf.Write(s.data)
+	}
+	if orientation != 1 {
+		buf.Write(orientationSegment(orientation))
+	}
+	buf.Write(rest)
+	return buf.Bytes()
+}
+
+// PNG のチャンクのうち、Exif とテキスト (XMP もここに入る) は捨てる
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+}
+
+// stripPngMetadata は PNG からメタデータのチャンクを取り除く。
+// 読めない PNG はそのまま返す (readUpload でデコードできることは確かめてある)。
+func stripPngMetadata(data []byte) []byte {
+	const signatureLen = 8
+	if len(data) < signatureLen {
+		return data
+	}
+	buf := bytes.NewBuffer(append([]byte{}, data[:signatureLen]...))
+	i := signatureLen
+	for i+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		// 長さ, 種類, 中身, CRC
+		end := i + 12 + length
+		if length < 0 || end > len(data) || end < i {
+			return data
+		}
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			buf.Write(data[i:end])
+		}
+		i = end
+	}
+	if i != len(data) {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// webpVP8XMetadataFlags は VP8X チャンクの flags のうち EXIF (0x08) と XMP (0x04)
+const webpVP8XMetadataFlags = 0x08 | 0x04
+
+// stripWebpMetadata は WebP から EXIF と XMP のチャンクを取り除き、
+// VP8X の flags と RIFF の大きさを直す。読めない WebP はそのまま返す。
+func stripWebpMetadata(data []byte) []byte {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return data
+	}
+	buf := bytes.NewBuffer(append([]byte{}, data[:12]...))
+	i := 12
+	for i+8 <= len(data) {
+		fourcc := string(data[i : i+4])
+		length := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		// チャンクは偶数バイトに揃えられている
+		end := i + 8 + length + length%2
+		if length < 0 || end > len(data) || end < i {
+			return data
+		}
+		if fourcc == "EXIF" || fourcc == "XMP " {
+			i = end
+			continue
+		}
+		chunk := append([]byte{}, data[i:end]...)
+		if fourcc == "VP8X" && 9 <= len(chunk) {
+			chunk[8] &^= webpVP8XMetadataFlags
+		}
+		buf.Write(chunk)
+		i = end
+	}
+	if i != len(data) {
+		return data
+	}
+	out := buf.Bytes()
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out
+}
+
+// swapsAxes は Orientation が縦横を入れ替えるもの (5 から 8) かを返す。
+func swapsAxes(orientation int) bool {
+	return 5 <= orientation && orientation <= 8
+}
+
+// toRGBA は src を *image.RGBA にする。すでに RGBA ならそのまま返す。
+func toRGBA(src imagepkg.Image) *imagepkg.RGBA {
+	if rgba, ok := src.(*imagepkg.RGBA); ok {
+		return rgba
+	}
+	b := src.Bounds()
+	dst := imagepkg.NewRGBA(imagepkg.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// applyOrientation は Exif の Orientation に従って画像を正立させる。
+// 縮小した後の小さな画像に使うこと。画素は Pix を直接読み書きする。
+func applyOrientation(src imagepkg.Image, orientation int) imagepkg.Image {
+	if orientation < 2 || 8 < orientation {
+		return src
+	}
+	rgba := toRGBA(src)
+	b := rgba.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if swapsAxes(orientation) {
+		dw, dh = h, w
+	}
+	dst := imagepkg.NewRGBA(imagepkg.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+dw*4]
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			i := rgba.PixOffset(b.Min.X+sx, b.Min.Y+sy)
+			copy(row[x*4:x*4+4], rgba.Pix[i:i+4])
+		}
+	}
+	return dst
+}
+
+// decodeOriented は画像をデコードし、向きは反映せずに Exif の Orientation と一緒に返す。
+// 縮小してから applyOrientation すれば、大きな画像を回さずに済む。
+func decodeOriented(data []byte) (imagepkg.Image, int, error) {
+	image, _, err := imagepkg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 1, err
+	}
+	return image, jpegOrientation(data), nil
+}
+
+// decodeImage は画像をデコードし、JPEG なら Exif の向きを反映する。
+// 元の大きさのまま使うとき (形式の変換) のためのもの。
+func decodeImage(data []byte) (imagepkg.Image, error) {
+	image, orientation, err := decodeOriented(data)
+	if err != nil {
+		return nil, err
+	}
+	return applyOrientation(image, orientation), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	imagepkg "image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	_ "golang.org/x/image/webp"
+)
+
+// 消えているべき値。テスト用の画像のメタデータにだけ入れる。
+const (
+	gpsSecret  = "GPS-35.6895N-139.6917E"
+	xmpSecret  = "XMP-CREATOR-SECRET"
+	iptcSecret = "IPTC-BYLINE-SECRET"
+)
+
+func testImage(t *testing.T) imagepkg.Image {
+	m := imagepkg.NewRGBA(imagepkg.Rect(0, 0, 16, 8))
+	for i := range m.Pix {
+		m.Pix[i] = byte(i * 7)
+	}
+	return m
+}
+
+func jpegSegmentBytes(marker byte, payload []byte) []byte {
+	s := []byte{0xff, marker, 0x00, 0x00}
+	binary.BigEndian.PutUint16(s[2:4], uint16(len(payload)+2))
+	return append(s, payload...)
+}
+
+// testJpeg は Exif (Orientation 6 と GPS の代わりの文字列), XMP, IPTC を持つ JPEG を作る。
+func testJpeg(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, testImage(t), nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	exif := orientationSegment(6)[4:]
+	exif = append(append([]byte{}, exif...), gpsSecret...)
+	xmp := append(append([]byte{}, xmpHeader...), "<x:xmpmeta>"+xmpSecret+"</x:xmpmeta>"...)
+	iptc := []byte("Photoshop 3.0\x00" + iptcSecret)
+
+	out := append([]byte{}, plain[:2]...)
+	out = append(out, jpegSegmentBytes(jpegAPP1, exif)...)
+	out = append(out, jpegSegmentBytes(jpegAPP1, xmp)...)
+	out = append(out, jpegSegmentBytes(jpegAPP13, iptc)...)
+	return append(out, plain[2:]...)
+}
+
+func pngChunk(kind string, data []byte) []byte {
+	c := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(c[0:4], uint32(len(data)))
+	copy(c[4:8], kind)
+	c = append(c, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(c[4:]))
+	return append(c, crc...)
+}
+
+// testPng は IHDR の直後にメタデータのチャンクを入れた PNG と、元の PNG を返す。
+func testPng(t *testing.T) ([]byte, []byte) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, testImage(t)); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+	// 署名 8 バイトと IHDR 25 バイト
+	ihdrEnd := 8 + 25
+	out := append([]byte{}, plain[:ihdrEnd]...)
+	out = append(out, pngChunk("tEXt", []byte("Comment\x00"+gpsSecret))...)
+	out = append(out, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"+xmpSecret))...)
+	out = append(out, pngChunk("eXIf", append(orientationSegment(6)[10:], gpsSecret...))...)
+	return append(out, plain[ihdrEnd:]...), plain
+}
+
+// testWebp は 1x1 の lossless WebP に VP8X と EXIF, XMP のチャンクを付けたもの。
+func testWebp() []byte {
+	vp8l := []byte("VP8L\x0d\x00\x00\x00\x2f\x00\x00\x00\x10\x07\x10\x11\x11\x88\x88\xfe\x07\x00")
+	w := []byte("RIFF\x00\x00\x00\x00WEBP")
+	w = append(w, []byte("VP8X\x0a\x00\x00\x00\x0c\x00\x00\x00\x00\x00\x00\x00\x00\x00")...)
+	w = append(w, vp8l...)
+	// 長さが奇数のチャンクには詰め物の 1 バイトが付く
+	exif := gpsSecret + "!"
+	w = append(w, "EXIF"...)
+	w = binary.LittleEndian.AppendUint32(w, uint32(len(exif)))
+	w = append(w, exif...)
+	w = append(w, 0)
+	w = append(w, "XMP "...)
+	w = binary.LittleEndian.AppendUint32(w, uint32(len(xmpSecret)))
+	w = append(w, xmpSecret...)
+	binary.LittleEndian.PutUint32(w[4:8], uint32(len(w)-8))
+	return w
+}
+
+func assertNoSecrets(t *testing.T, name string, data []byte) {
+	for _, secret := range []string{gpsSecret, xmpSecret, iptcSecret} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("%s: %q is still present", name, secret)
+		}
+	}
+}
+
+func assertDecodes(t *testing.T, name string, data []byte) {
+	if _, _, err := imagepkg.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("%s: output does not decode: %v", name, err)
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	jpg := testJpeg(t)
+	pngWithText, pngPlain := testPng(t)
+	webp := testWebp()
+
+	tests := []struct {
+		name string
+		data []byte
+		ext  string
+	}{
+		{"jpeg", jpg, "jpg"},
+		{"png", pngWithText, "png"},
+		{"webp", webp, "webp"},
+	}
+	for _, tt := range tests {
+		assertDecodes(t, tt.name+" input", tt.data)
+		out := stripMetadata(tt.data, tt.ext)
+		assertNoSecrets(t, tt.name, out)
+		assertDecodes(t, tt.name, out)
+	}
+
+	if got := jpegOrientation(stripMetadata(jpg, "jpg")); got != 6 {
+		t.Errorf("jpeg: orientation = %d, want 6", got)
+	}
+	if out := stripMetadata(pngWithText, "png"); !bytes.Equal(out, pngPlain) {
+		t.Errorf("png: output differs from the image without metadata chunks")
+	}
+	out := stripMetadata(webp, "webp")
+	if out[20]&webpVP8XMetadataFlags != 0 {
+		t.Errorf("webp: VP8X flags = %#x, metadata flags are still set", out[20])
+	}
+	if size := int(binary.LittleEndian.Uint32(out[4:8])); size != len(out)-8 {
+		t.Errorf("webp: RIFF size = %d, want %d", size, len(out)-8)
+	}
+}
+
+func TestStripMetadataMalformed(t *testing.T) {
+	jpg := testJpeg(t)
+	pngWithText, _ := testPng(t)
+	webp := testWebp()
+
+	tests := []struct {
+		name string
+		data []byte
+		ext  string
+	}{
+		{"empty jpeg", []byte{}, "jpg"},
+		{"jpeg cut in a segment", jpg[:20], "jpg"},
+		{"jpeg without SOI", jpg[2:], "jpg"},
+		{"empty png", []byte{}, "png"},
+		{"png cut in a chunk", pngWithText[:40], "png"},
+		{"webp cut in a chunk", webp[:len(webp)-3], "webp"},
+		{"webp without header", webp[12:], "webp"},
+		{"gif", []byte("GIF89a" + gpsSecret), "gif"},
+	}
+	for _, tt := range tests {
+		if out := stripMetadata(tt.data, tt.ext); !bytes.Equal(out, tt.data) {
+			t.Errorf("%s: malformed input was changed", tt.name)
+		}
+	}
+}
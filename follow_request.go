@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type FollowRequest struct {
+	Id        int
+	User      int
+	Target    int
+	CreatedAt string
+}
+
+func updatePrivateHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	private := r.FormValue("private")
+	if !(private == "0" || private == "1") {
+		badRequest(w)
+		return
+	}
+
+	_, err = dbConn.Exec(
+		"UPDATE users SET private = ? WHERE id = ?",
+		private, user.Id,
+	)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	renderJson(w, Response{
+		"id":      user.Id,
+		"name":    user.Name,
+		"icon":    baseUrl.String() + "/icon/" + user.Icon,
+		"private": private == "1",
+	})
+}
+
+// followRequestsHandler は自分宛ての保留中の follow リクエストを新しい順に返す。
+func followRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	rows, err := dbConn.Query(
+		"SELECT follow_requests.id, follow_requests.created_at, users.id, users.name, users.icon FROM follow_requests JOIN users ON (follow_requests.user = users.id) WHERE follow_requests.target = ? ORDER BY follow_requests.created_at DESC",
+		user.Id,
+	)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	res := []Response{}
+	for rows.Next() {
+		req := FollowRequest{}
+		u := User{}
+		rows.Scan(&req.Id, &req.CreatedAt, &u.Id, &u.Name, &u.Icon)
+		res = append(res, Response{
+			"id":         req.Id,
+			"created_at": req.CreatedAt,
+			"user": Response{
+				"id":   u.Id,
+				"name": u.Name,
+				"icon": baseUrl.String() + "/icon/" + u.Icon,
+			},
+		})
+	}
+	rows.Close()
+
+	renderJsonNoCache(w, Response{"requests": res})
+}
+
+// answerFollowRequestHandler は follow リクエストを承認または拒否する。
+// 承認したときだけ follow_map に入り、publish_level 1 の entry が見えるようになる。
+func answerFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
+	prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	vars := mux.Vars(r)
+	req := FollowRequest{}
+	err = dbConn.QueryRow(
+		"SELECT id, user, target, created_at FROM follow_requests WHERE id = ?", vars["id"],
+	).Scan(
+		&req.Id, &req.User, &req.Target, &req.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	if req.Target != user.Id {
+		notFound(w)
+		return
+	}
+
+	if vars["action"] == "approve" {
+		_, err = dbConn.Exec(
+			"INSERT IGNORE INTO follow_map (user, target, created_at) VALUES (?, ?, NOW())",
+			req.User, req.Target,
+		)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	_, err = dbConn.Exec("DELETE FROM follow_requests WHERE id = ?", req.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	renderJson(w, Response{"ok": true})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+const subscriptionBuffer = 64
+
+type Event struct {
+	Type  string
+	Entry Entry
+}
+
+// Hub は新着 entry をプロセス内の購読者に配る。
+// 購読者ごとの可視性判定は受け取った側で行う。
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	C   chan Event
+	hub *Hub
+}
+
+func newHub() *Hub {
+	return &Hub{subscribers: map[*Subscription]struct{}{}}
+}
+
+func (h *Hub) Subscribe() *Subscription {
+	s := &Subscription{C: make(chan Event, subscriptionBuffer), hub: h}
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// Publish は購読者を待たない。バッファが溢れた購読者へのイベントは捨てる。
+func (h *Hub) Publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		select {
+		case s.C <- ev:
+		default:
+			log.Println("Drop event for slow subscriber", ev.Type, ev.Entry.Id)
+		}
+	}
+}
+
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	delete(s.hub.subscribers, s)
+	s.hub.mu.Unlock()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	imagepkg "image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "golang.org/x/image/webp"
+)
+
+// 拡張子ごとの Content-Type。webp はデコードのみで、エンコードはできない。
+var imageMimeTypes = map[string]string{
+	"jpg":  "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+// image.Decode が返す形式名から保存時の拡張子への対応
+var decoderExts = map[string]string{
+	"jpeg": "jpg",
+	"png":  "png",
+	"gif":  "gif",
+	"webp": "webp",
+}
+
+func canEncode(ext string) bool {
+	return ext == "jpg" || ext == "png" || ext == "gif"
+}
+
+// EncodeOptions はエンコーダの設定。ゼロ値はそれぞれの既定値。
+type EncodeOptions struct {
+	// Quality は JPEG の品質 (1 から 100)
+	Quality int
+	// Progressive なら JPEG を progressive で書く (encodeProgressiveJpeg)
+	Progressive bool
+	// PNGCompression は default, none, speed, best のいずれか
+	PNGCompression string
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"":        png.DefaultCompression,
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// encodeImage は image を ext でエンコードする。
+func encodeImage(image imagepkg.Image, ext string, options EncodeOptions) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var err error
+	if ext == "jpg" && options.Progressive {
+		err = encodeProgressiveJpeg(buf, image, options.Quality)
+	} else if ext == "jpg" {
+		var jpegOptions *jpeg.Options
+		if 0 < options.Quality {
+			jpegOptions = &jpeg.Options{Quality: options.Quality}
+		}
+		err = jpeg.Encode(buf, image, jpegOptions)
+	} else if ext == "png" {
+		encoder := png.Encoder{CompressionLevel: pngCompressionLevels[options.PNGCompression]}
+		err = encoder.Encode(buf, image)
+	} else if ext == "gif" {
+		err = gif.Encode(buf, image, nil)
+	} else {
+		err = errors.New("cannot encode " + ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// transcode は画像の大きさを変えずに形式だけを変える。
+func transcode(data []byte, ext string, options EncodeOptions) ([]byte, error) {
+	image, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	return encodeImage(image, ext, options)
+}
+
+// accepts は Accept ヘッダーが mimeType を受け付けるかを返す。q=0 は拒否とみなす。
+func accepts(accept string, mimeType string) bool {
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		t := strings.TrimSpace(params[0])
+		if !(t == mimeType || t == "*/*" || t == "image/*") {
+			continue
+		}
+		rejected := false
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[len("q="):], 64)
+				rejected = err == nil && q == 0
+			}
+		}
+		if !rejected {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateFormat は Accept ヘッダーから返す画像の形式を選ぶ。
+// 元画像の形式をそのまま返せるなら優先し、だめなら jpg, png, gif の順に試す。
+// passthrough が false のときは元画像の形式でもエンコードできる必要がある。
+func negotiateFormat(accept string, original string, passthrough bool) string {
+	if (passthrough || canEncode(original)) && accepts(accept, imageMimeTypes[original]) {
+		return original
+	}
+	for _, ext := range []string{"jpg", "png", "gif"} {
+		if accepts(accept, imageMimeTypes[ext]) {
+			return ext
+		}
+	}
+	return "jpg"
+}
+
+// getImageFormat は保存されている元画像の拡張子を返す。
+// entry_images ができる前の画像はすべて jpg。
+func getImageFormat(image string) (string, error) {
+	var format string
+	err := dbConn.QueryRow(
+		"SELECT format FROM entry_images WHERE image = ?", image,
+	).Scan(&format)
+	if err == sql.ErrNoRows {
+		return "jpg", nil
+	}
+	return format, err
+}
+
+const (
+	// icon の id はアップロードごとに変わるが、preset の設定を変えると同じ URL の中身が変わる
+	iconCacheControl = "public, max-age=86400"
+	// publish_level はあとから非公開にできるので、公開画像でも毎回確かめさせる
+	publicImageCacheControl = "public, no-cache"
+	// 非公開の画像は共有キャッシュに置かせず、毎回閲覧できるかを確かめさせる
+	privateImageCacheControl = "private, no-cache"
+)
+
+// imageCacheControl は entry の公開範囲に応じた Cache-Control を返す。
+func imageCacheControl(entry Entry) string {
+	if entry.PublishLevel == 2 {
+		return publicImageCacheControl
+	}
+	return privateImageCacheControl
+}
+
+// variantNotModified は key の画像についてキャッシュ用のヘッダーを付け、
+// If-None-Match か If-Modified-Since でクライアントの持つものが新しければ 304 を返して true を返す。
+// 同じ key の中身は変わらないので key から強い ETag を作れ、画像を作る前に判定できる。
+// modTime は原本を保存した時刻。
+func variantNotModified(w http.ResponseWriter, r *http.Request, key VariantKey, modTime time.Time, cacheControl string) bool {
+	etag := key.ETag()
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatches(inm, etag) {
+			return false
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || ims.Before(modTime.Truncate(time.Second)) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches は If-None-Match の値に etag が含まれるかを弱い比較で調べる。
+func etagMatches(header string, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveVariant は画像 data を返す。Range と If-Range は http.ServeContent に任せる。
+// ヘッダーは variantNotModified で付けてあるものを使う。
+func serveVariant(w http.ResponseWriter, r *http.Request, key VariantKey, data []byte, modTime time.Time) {
+	w.Header().Set("Content-Type", imageMimeTypes[key.Ext])
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// getLikeStats は entry の like 数と viewer が like しているかを返す。
+func getLikeStats(entryId int, viewer *User) (int, bool, error) {
+	viewerId := 0
+	if viewer != nil {
+		viewerId = viewer.Id
+	}
+	var count, mine int
+	err := dbConn.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(user = ?), 0) FROM likes WHERE entry = ?",
+		viewerId, entryId,
+	).Scan(&count, &mine)
+	if err != nil {
+		return 0, false, err
+	}
+	return count, 0 < mine, nil
+}
+
+// likeHandler は POST で like し、DELETE (または __method=DELETE) で取り消す。
+// 見えない entry には like できない。
+func likeHandler(w http.ResponseWriter, r *http.Request) {
+	prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	entry, err := getEntryById(mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	if ok, err := policy.CanView(user, entry); err != nil {
+		serverError(w, err)
+		return
+	} else if !ok {
+		notFound(w)
+		return
+	}
+
+	if r.Method == "DELETE" || r.FormValue("__method") == "DELETE" {
+		_, err = dbConn.Exec(
+			"DELETE FROM likes WHERE entry = ? AND user = ?",
+			entry.Id, user.Id,
+		)
+	} else {
+		var result sql.Result
+		result, err = dbConn.Exec(
+			"INSERT IGNORE INTO likes (entry, user, created_at) VALUES (?, ?, NOW())",
+			entry.Id, user.Id,
+		)
+		if err == nil && inserted(result) {
+			// like と取り消しを繰り返しても通知は 1 つだけにする
+			var notified bool
+			notified, err = exists(
+				"SELECT 1 FROM notifications WHERE user = ? AND kind = ? AND actor = ? AND entry = ?",
+				entry.User, notifyLike, user.Id, entry.Id,
+			)
+			if err == nil && !notified {
+				notify(Notification{User: entry.User, Kind: notifyLike, Actor: user.Id, Entry: entry.Id})
+			}
+		}
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	likeCount, likedByMe, err := getLikeStats(entry.Id, user)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	renderJson(w, Response{
+		"id":          entry.Id,
+		"like_count":  likeCount,
+		"liked_by_me": likedByMe,
+	})
+}
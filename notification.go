@@ -0,0 +1,187 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	notifyFollow        = "follow"
+	notifyFollowRequest = "follow_request"
+	notifyLike          = "like"
+	notifyComment       = "comment"
+)
+
+type Notification struct {
+	Id        int
+	User      int
+	Kind      string
+	Actor     int
+	Entry     int
+	Comment   int
+	Read      bool
+	CreatedAt string
+}
+
+// notify は通知を書き込む唯一の入口。自分自身の操作は通知しない。
+// 通知は本来の操作の付随物なので、失敗してもログに残すだけにする。
+func notify(n Notification) {
+	if n.User == n.Actor {
+		return
+	}
+	_, err := dbConn.Exec(
+		"INSERT INTO notifications (user, kind, actor, entry, comment, is_read, created_at) VALUES (?, ?, ?, ?, ?, 0, NOW())",
+		n.User, n.Kind, n.Actor, n.Entry, n.Comment,
+	)
+	if err != nil {
+		log.Println("Failed to write notification", n.Kind, err)
+	}
+}
+
+func countUnread(userId int) (int, error) {
+	var count int
+	err := dbConn.QueryRow(
+		"SELECT COUNT(*) FROM notifications WHERE user = ? AND is_read = 0", userId,
+	).Scan(&count)
+	return count, err
+}
+
+// notificationsHandler は通知を新しい順に返す。before に前回の next_cursor を渡すと続きを返す。
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	before, err := strconv.Atoi(r.FormValue("before"))
+	if err != nil {
+		before = 0
+	}
+	limit := parseLimit(r)
+
+	query := "SELECT id, user, kind, actor, entry, comment, is_read, created_at FROM notifications WHERE user = ?"
+	args := []interface{}{user.Id}
+	if 0 < before {
+		query += " AND id < ?"
+		args = append(args, before)
+	}
+	if r.FormValue("unread") == "1" {
+		query += " AND is_read = 0"
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	notifications := []Notification{}
+	for rows.Next() {
+		n := Notification{}
+		rows.Scan(&n.Id, &n.User, &n.Kind, &n.Actor, &n.Entry, &n.Comment, &n.Read, &n.CreatedAt)
+		notifications = append(notifications, n)
+	}
+	rows.Close()
+
+	res := []Response{}
+	for _, n := range notifications {
+		actor, err := getUserById(n.Actor)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		item := Response{
+			"id":         n.Id,
+			"kind":       n.Kind,
+			"read":       n.Read,
+			"created_at": n.CreatedAt,
+			"actor": Response{
+				"id":   actor.Id,
+				"name": actor.Name,
+				"icon": baseUrl.String() + "/icon/" + actor.Icon,
+			},
+		}
+		if 0 < n.Entry {
+			item["entry"] = n.Entry
+		}
+		if 0 < n.Comment {
+			item["comment"] = n.Comment
+		}
+		res = append(res, item)
+	}
+
+	unread, err := countUnread(user.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	var cursor interface{}
+	if len(notifications) == limit {
+		cursor = notifications[len(notifications)-1].Id
+	}
+	renderJsonNoCache(w, Response{
+		"unread":        unread,
+		"next_cursor":   cursor,
+		"notifications": res,
+	})
+}
+
+// readNotificationsHandler は id で指定した通知を既読にする。id が無ければ全て既読にする。
+func readNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		serverError(w, err)
+		return
+	}
+
+	if ids := r.Form["id"]; 0 < len(ids) {
+		for _, idStr := range ids {
+			id, _ := strconv.Atoi(idStr)
+			_, err := dbConn.Exec(
+				"UPDATE notifications SET is_read = 1 WHERE id = ? AND user = ?",
+				id, user.Id,
+			)
+			if err != nil {
+				serverError(w, err)
+				return
+			}
+		}
+	} else {
+		_, err := dbConn.Exec(
+			"UPDATE notifications SET is_read = 1 WHERE user = ? AND is_read = 0",
+			user.Id,
+		)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	unread, err := countUnread(user.Id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	renderJson(w, Response{"unread": unread})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// Relations は Policy が参照するユーザー間の関係。
+type Relations interface {
+	// Follows は user が target を follow しているかを返す。
+	Follows(user, target int) (bool, error)
+	// Blocks は user が target をブロックしているかを返す。
+	Blocks(user, target int) (bool, error)
+}
+
+// Policy は entry とその画像を誰に見せてよいかを決める。
+// CanView と EntriesSQL は同じ規則を Go と SQL でそれぞれ表したもの。
+//
+//	publish_level 0: 所有者のみ
+//	publish_level 1: 所有者と follower のみ
+//	publish_level 2: 全員 (未ログインを含む)
+//
+// 所有者にブロックされているユーザーには publish_level 2 以外は見えない。
+type Policy struct {
+	Relations Relations
+}
+
+var policy = &Policy{Relations: dbRelations{}}
+
+// CanView は viewer が entry を見られるかを返す。viewer が nil のときは未ログイン。
+func (p *Policy) CanView(viewer *User, entry Entry) (bool, error) {
+	if entry.PublishLevel == 2 {
+		return true, nil
+	}
+	if viewer == nil {
+		return false, nil
+	}
+	if entry.User == viewer.Id {
+		return true, nil
+	}
+	if entry.PublishLevel != 1 {
+		return false, nil
+	}
+	blocked, err := p.Relations.Blocks(entry.User, viewer.Id)
+	if err != nil || blocked {
+		return false, err
+	}
+	return p.Relations.Follows(viewer.Id, entry.User)
+}
+
+// CanViewFollows は viewer が owner の following と followers の一覧を見られるかを返す。
+// 非公開アカウントの一覧は本人と承認済みの follower だけが見られる。
+// ブロックされているユーザーには公開アカウントでも見せない。
+func (p *Policy) CanViewFollows(viewer *User, owner User) (bool, error) {
+	if viewer != nil && viewer.Id == owner.Id {
+		return true, nil
+	}
+	if viewer != nil {
+		blocked, err := p.Relations.Blocks(owner.Id, viewer.Id)
+		if err != nil || blocked {
+			return false, err
+		}
+	}
+	if !owner.Private {
+		return true, nil
+	}
+	if viewer == nil {
+		return false, nil
+	}
+	return p.Relations.Follows(viewer.Id, owner.Id)
+}
+
+// EntriesSQL は CanView と同じ条件を entries に対する WHERE 句として返す。
+// table には entries の別名 (なければ "entries") を渡す。
+func (p *Policy) EntriesSQL(viewer *User, table string) (string, []interface{}) {
+	if viewer == nil {
+		return "(" + table + ".publish_level=2)", []interface{}{}
+	}
+	return "(" + table + ".user=? OR " + table + ".publish_level=2 OR (" +
+			table + ".publish_level=1 AND " +
+			table + ".user IN (SELECT target FROM follow_map WHERE user=?) AND " +
+			table + ".user NOT IN (SELECT user FROM blocks WHERE target=?)))",
+		[]interface{}{viewer.Id, viewer.Id, viewer.Id}
+}
+
+type dbRelations struct{}
+
+func (dbRelations) Follows(user, target int) (bool, error) {
+	return exists("SELECT 1 FROM follow_map WHERE user = ? AND target = ?", user, target)
+}
+
+func (dbRelations) Blocks(user, target int) (bool, error) {
+	return exists("SELECT 1 FROM blocks WHERE user = ? AND target = ?", user, target)
+}
+
+func exists(query string, args ...interface{}) (bool, error) {
+	var one int
+	err := dbConn.QueryRow(query, args...).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+)
+
+const retryAfterSeconds = 1
+
+var errPoolBusy = errors.New("render pool is busy")
+
+// Pool は画像の縮小などの重い処理を決まった数の worker で実行する。
+// キューが一杯なら Do は待たずに errPoolBusy を返す。
+type Pool struct {
+	jobs     chan func()
+	workers  int
+	running  int64
+	rejected int64
+}
+
+var renderPool *Pool
+
+func newPool(workers int, queue int) *Pool {
+	p := &Pool{jobs: make(chan func(), queue), workers: workers}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *Pool) work() {
+	for job := range p.jobs {
+		p.run(job)
+	}
+}
+
+// run は job を実行する。デコーダなどが panic しても worker は止めない。
+func (p *Pool) run(job func()) {
+	atomic.AddInt64(&p.running, 1)
+	defer atomic.AddInt64(&p.running, -1)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic in render pool: %v\n%s", r, debug.Stack())
+		}
+	}()
+	job()
+}
+
+// Submit はキューに空きができるまで待って job を入れる。Convertfile のような一括処理用。
+func (p *Pool) Submit(job func()) {
+	p.jobs <- job
+}
+
+// TrySubmit はキューに空きがなければ job を入れずに false を返す。
+func (p *Pool) TrySubmit(job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		atomic.AddInt64(&p.rejected, 1)
+		return false
+	}
+}
+
+// Do は fn を worker で実行して結果を待つ。fn が panic したらエラーとして返す。
+func (p *Pool) Do(fn func() ([]byte, error)) ([]byte, error) {
+	var data []byte
+	var err error
+	done := make(chan struct{})
+	ok := p.TrySubmit(func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("panic in render pool: %v\n%s", r, debug.Stack())
+				data, err = nil, fmt.Errorf("render panicked: %v", r)
+			}
+		}()
+		data, err = fn()
+	})
+	if !ok {
+		return nil, errPoolBusy
+	}
+	<-done
+	return data, err
+}
+
+// Crowded はキューが半分より埋まっているかを返す。
+// 後回しにできる処理は、利用者を待たせている処理のために空きを残しておく。
+func (p *Pool) Crowded() bool {
+	return cap(p.jobs)/2 < len(p.jobs)
+}
+
+func (p *Pool) Stats() map[string]int64 {
+	return map[string]int64{
+		"workers":        int64(p.workers),
+		"queue_capacity": int64(cap(p.jobs)),
+		"queue_length":   int64(len(p.jobs)),
+		"running":        atomic.LoadInt64(&p.running),
+		"rejected":       atomic.LoadInt64(&p.rejected),
+	}
+}
+
+// openRenderPool は config から renderPool を作り、/debug/vars に統計を出す。
+func openRenderPool(config *Config) {
+	workers := config.RenderWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	queue := config.RenderQueue
+	if queue <= 0 {
+		queue = workers * 4
+	}
+	renderPool = newPool(workers, queue)
+	expvar.Publish("render_pool", expvar.Func(func() interface{} {
+		return renderPool.Stats()
+	}))
+}
+
+// renderFailed は画像の生成に失敗したときのレスポンスを返す。
+// 混んでいるだけなら 503 にして、少し後に再試行させる。
+func renderFailed(w http.ResponseWriter, err error) {
+	// variantNotModified が付けたヘッダーでエラーがキャッシュされないようにする
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+	w.Header().Set("Cache-Control", "no-store")
+	if err == errPoolBusy {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	serverError(w, err)
+}
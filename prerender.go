@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// presetExt は Accept を見ないときに preset を作る形式。
+// webp はエンコードできないので縮小画像は jpg で作る。
+func presetExt(preset Preset, format string) string {
+	if preset.Format != "" {
+		return preset.Format
+	}
+	if preset.Resized() && !canEncode(format) {
+		return "jpg"
+	}
+	return format
+}
+
+// prerenderImages はアップロードされた画像の縮小する preset を裏で作り、staticStore に置いておく。
+// 最初に見た人が縮小を待たずに済むようにするためで、renderPool のキューが
+// 半分より埋まっていれば諦めて imageHandler で必要になったときに作る。
+// まだ誰も見ていない画像で variantCache を埋めないよう、キャッシュには入れない。
+func prerenderImages(images []string, formats []string) {
+	go func() {
+		for i, image := range images {
+			for _, preset := range imagePresets() {
+				// 元の大きさのものは縮小しないので、前もって作る意味がない
+				if !preset.Resized() {
+					continue
+				}
+				preset, image, format := preset, image, formats[i]
+				ext := presetExt(preset, format)
+				key := presetKey("image", image, preset, ext)
+				_, err := staticStore.Stat(key.Path())
+				if err == nil {
+					continue
+				} else if err == ErrBlobNotFound {
+					_, err = renderAndStore(key, func() ([]byte, error) {
+						return renderImage(image, format, preset, nil, ext)
+					})
+				}
+				if err == errPoolBusy {
+					log.Println("Skip prerendering", image, "render pool is busy")
+					return
+				} else if err != nil {
+					log.Println("Failed to prerender", key.Path(), err)
+				}
+			}
+		}
+	}()
+}
+
+// variantsReady は image の preset ごとに、presetExt の形式で作り終えているかを返す。
+func variantsReady(image string) (Response, error) {
+	format, err := getImageFormat(image)
+	if err != nil {
+		return nil, err
+	}
+	ready := Response{}
+	for _, preset := range imagePresets() {
+		// 元の大きさで形式も同じなら原本をそのまま返すので、いつでも用意できている
+		if !preset.Resized() && presetExt(preset, format) == format {
+			ready[preset.Name] = true
+			continue
+		}
+		key := presetKey("image", image, preset, presetExt(preset, format))
+		if variantCache.Has(key) {
+			ready[preset.Name] = true
+			continue
+		}
+		_, err := staticStore.Stat(key.Path())
+		if err != nil && err != ErrBlobNotFound {
+			return nil, err
+		}
+		ready[preset.Name] = err == nil
+	}
+	return ready, nil
+}
+
+// withVariants は variants=1 が指定されていれば、entryResponse で作った res の
+// images に preset ごとの準備状況を ready として足す。
+func withVariants(r *http.Request, res Response, entry Entry) error {
+	if r.FormValue("variants") != "1" {
+		return nil
+	}
+	imageIds, err := getEntryImages(entry)
+	if err != nil {
+		return err
+	}
+	images := res["images"].([]Response)
+	for i, imageId := range imageIds {
+		ready, err := variantsReady(imageId)
+		if err != nil {
+			return err
+		}
+		images[i]["ready"] = ready
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Preset は size パラメータで選べる画像の大きさ。
+// Width が 0 なら元の大きさのまま返す。Height が 0 なら Width と同じ。
+// Crop は Variant の Fit と同じく cover か contain。
+// Format が空なら Accept ヘッダーで決める。
+// Quality, Progressive, PNGCompression は EncodeOptions に渡され、空ならエンコーダの既定値を使う。
+type Preset struct {
+	Name           string `json:"name"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	Crop           string `json:"crop"`
+	Format         string `json:"format"`
+	Quality        int    `json:"quality"`
+	Progressive    bool   `json:"progressive"`
+	PNGCompression string `json:"png_compression"`
+}
+
+var defaultIconPresets = []Preset{
+	{Name: "s", Width: 32, Crop: "cover", Format: "png"},
+	{Name: "m", Width: 64, Crop: "cover", Format: "png"},
+	{Name: "l", Width: 128, Crop: "cover", Format: "png"},
+}
+
+var defaultImagePresets = []Preset{
+	{Name: "s", Width: 128, Crop: "cover"},
+	{Name: "m", Width: 256, Crop: "cover"},
+	{Name: "l"},
+}
+
+func iconPresets() []Preset {
+	if config != nil && 0 < len(config.IconPresets) {
+		return config.IconPresets
+	}
+	return defaultIconPresets
+}
+
+func imagePresets() []Preset {
+	if config != nil && 0 < len(config.ImagePresets) {
+		return config.ImagePresets
+	}
+	return defaultImagePresets
+}
+
+// validatePresets は設定ファイルの preset を確かめる。
+// 誤りがあると全リクエストが失敗したり黙って既定値になったりするので、起動時に落とす。
+func validatePresets(presets []Preset) error {
+	names := map[string]bool{}
+	for i, p := range presets {
+		if p.Name == "" {
+			return fmt.Errorf("preset %d has no name", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("preset %q is defined twice", p.Name)
+		}
+		names[p.Name] = true
+		if p.Width < 0 || maxVariantDimension < p.Width || p.Height < 0 || maxVariantDimension < p.Height {
+			return fmt.Errorf("preset %q: width and height must be between 0 and %d", p.Name, maxVariantDimension)
+		}
+		if p.Width == 0 && p.Height != 0 {
+			return fmt.Errorf("preset %q: height needs a width", p.Name)
+		}
+		if !(p.Crop == "" || p.Crop == "cover" || p.Crop == "contain") {
+			return fmt.Errorf("preset %q: unknown crop %q", p.Name, p.Crop)
+		}
+		if p.Format != "" && !canEncode(p.Format) {
+			return fmt.Errorf("preset %q: cannot encode format %q", p.Name, p.Format)
+		}
+		if p.Quality < 0 || 100 < p.Quality {
+			return fmt.Errorf("preset %q: quality must be between 0 and 100", p.Name)
+		}
+		if _, ok := pngCompressionLevels[p.PNGCompression]; !ok {
+			return fmt.Errorf("preset %q: unknown png_compression %q", p.Name, p.PNGCompression)
+		}
+	}
+	return nil
+}
+
+// findPreset は name の preset を返す。見つからなければ fallback の preset を返す。
+func findPreset(presets []Preset, name string, fallback string) Preset {
+	for _, p := range presets {
+		if p.Name == name {
+			return p
+		}
+	}
+	for _, p := range presets {
+		if p.Name == fallback {
+			return p
+		}
+	}
+	return presets[0]
+}
+
+func (p Preset) Resized() bool {
+	return 0 < p.Width
+}
+
+// Version は p の設定から作る短いハッシュ。設定を変えると変わるので、
+// 作った画像の保存先と ETag に入れて古い画像を使わないようにする。
+func (p Preset) Version() string {
+	b, _ := json.Marshal(p)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:4])
+}
+
+// presetKey は kind の id から p の大きさで作った ext 形式の画像の VariantKey。
+func presetKey(kind string, id string, p Preset, ext string) VariantKey {
+	return VariantKey{Kind: kind, Id: id, Size: p.Name, Version: p.Version(), Ext: ext}
+}
+
+func (p Preset) EncodeOptions() EncodeOptions {
+	return EncodeOptions{Quality: p.Quality, Progressive: p.Progressive, PNGCompression: p.PNGCompression}
+}
+
+func (p Preset) Variant() Variant {
+	height := p.Height
+	if height <= 0 {
+		height = p.Width
+	}
+	fit := p.Crop
+	if fit == "" {
+		fit = "cover"
+	}
+	return Variant{Width: p.Width, Height: height, Fit: fit}
+}
+
+// renderPreset は format 形式の元画像 original から p の大きさの画像を ext で作る。
+func renderPreset(original []byte, format string, p Preset, ext string) ([]byte, error) {
+	if !p.Resized() {
+		if ext == format {
+			return original, nil
+		}
+		return transcode(original, ext, p.EncodeOptions())
+	}
+	image, orientation, err := decodeOriented(original)
+	if err != nil {
+		return nil, err
+	}
+	return renderVariant(image, orientation, p.Variant(), ext, p.EncodeOptions())
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	imagepkg "image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// image/jpeg は baseline しか書けないので、progressive JPEG はここで作る。
+// 色差は間引かず (4:4:4)、ハフマン表は仕様書 K.3 の標準のものを使う。
+// 逐次近似は使わず、周波数帯ごとにスキャンを分けるだけにしている。
+
+// jpegZigzag は zig-zag 順の k 番目の係数が 8x8 ブロックのどこにあるか。
+var jpegZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegBaseQuant は仕様書 K.1 の量子化表 (輝度, 色差) を zig-zag 順にしたもの。
+var jpegBaseQuant = [2][64]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+type jpegHuffmanSpec struct {
+	counts [16]byte
+	values []byte
+}
+
+// jpegHuffmanSpecs は仕様書 K.3 のハフマン表。輝度 DC, 輝度 AC, 色差 DC, 色差 AC の順。
+var jpegHuffmanSpecs = [4]jpegHuffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// jpegHuffmanCode は 1 つの値の符号と、その長さ (0 なら表に無い)。
+type jpegHuffmanCode struct {
+	code uint32
+	size uint32
+}
+
+// jpegHuffmanCodes は jpegHuffmanSpecs から作った値ごとの符号。
+var jpegHuffmanCodes [4][256]jpegHuffmanCode
+
+func init() {
+	for i, spec := range jpegHuffmanSpecs {
+		code, k := uint32(0), 0
+		for length := 1; length <= 16; length++ {
+			for n := 0; n < int(spec.counts[length-1]); n++ {
+				jpegHuffmanCodes[i][spec.values[k]] = jpegHuffmanCode{code, uint32(length)}
+				code++
+				k++
+			}
+			code <<= 1
+		}
+	}
+}
+
+// jpegCosines[x][u] = cos((2x+1)uπ/16)
+var jpegCosines [8][8]float64
+
+func init() {
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			jpegCosines[x][u] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / 16)
+		}
+	}
+}
+
+// jpegComponent は 1 つの色成分。blocks は量子化済みの係数を zig-zag 順に持つ。
+type jpegComponent struct {
+	id     byte
+	table  int
+	blocks [][64]int16
+}
+
+// jpegScan は 1 回のスキャン。components は jpegComponent の添字。
+type jpegScan struct {
+	components []int
+	start, end int
+}
+
+type jpegBitWriter struct {
+	w     *bufio.Writer
+	bits  uint32
+	nbits uint32
+}
+
+func (b *jpegBitWriter) emit(bits, n uint32) {
+	b.bits = b.bits<<n | bits&(1<<n-1)
+	b.nbits += n
+	for 8 <= b.nbits {
+		c := byte(b.bits >> (b.nbits - 8))
+		b.w.WriteByte(c)
+		if c == 0xff {
+			b.w.WriteByte(0x00)
+		}
+		b.nbits -= 8
+	}
+}
+
+func (b *jpegBitWriter) emitHuffman(table int, value byte) {
+	c := jpegHuffmanCodes[table][value]
+	b.emit(c.code, c.size)
+}
+
+// emitValue は値の大きさの区分 (category) を符号化してから値そのものを書く。
+func (b *jpegBitWriter) emitValue(table int, run int, v int32) {
+	a, bits := v, v
+	if a < 0 {
+		a = -a
+		bits--
+	}
+	size := uint32(0)
+	for a != 0 {
+		size++
+		a >>= 1
+	}
+	b.emitHuffman(table, byte(run<<4)|byte(size))
+	if 0 < size {
+		b.emit(uint32(bits), size)
+	}
+}
+
+// flush は残りのビットを 1 で埋めて書き出す。
+func (b *jpegBitWriter) flush() {
+	if 0 < b.nbits {
+		b.emit(0x7f, 8-b.nbits%8)
+	}
+	b.bits, b.nbits = 0, 0
+}
+
+func jpegQuantTable(table int, quality int) [64]int {
+	if quality <= 0 {
+		quality = 75
+	} else if 100 < quality {
+		quality = 100
+	}
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var q [64]int
+	for i, base := range jpegBaseQuant[table] {
+		v := (base*scale + 50) / 100
+		if v < 1 {
+			v = 1
+		} else if 255 < v {
+			v = 255
+		}
+		q[i] = v
+	}
+	return q
+}
+
+// quantizeBlock は level shift 済みの画素を DCT して量子化し、zig-zag 順に並べる。
+func quantizeBlock(pixels *[64]float64, quant *[64]int) [64]int16 {
+	var tmp [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < 8; x++ {
+				sum += pixels[y*8+x] * jpegCosines[x][u]
+			}
+			tmp[y*8+u] = sum
+		}
+	}
+	var out [64]int16
+	for k, pos := range jpegZigzag {
+		v, u := pos/8, pos%8
+		sum := 0.0
+		for y := 0; y < 8; y++ {
+			sum += tmp[y*8+u] * jpegCosines[y][v]
+		}
+		cu, cv := 1.0, 1.0
+		if u == 0 {
+			cu = math.Sqrt2 / 2
+		}
+		if v == 0 {
+			cv = math.Sqrt2 / 2
+		}
+		out[k] = int16(math.Round(sum * cu * cv / 4 / float64(quant[k])))
+	}
+	return out
+}
+
+// encodeProgressiveJpeg は m を progressive JPEG で w に書く。quality が 0 なら 75。
+func encodeProgressiveJpeg(w io.Writer, m imagepkg.Image, quality int) error {
+	bounds := m.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || 65535 < width || 65535 < height {
+		return errors.New("jpeg: image is too large or empty")
+	}
+	_, gray := m.(*imagepkg.Gray)
+
+	quants := [2][64]int{jpegQuantTable(0, quality), jpegQuantTable(1, quality)}
+	components := []jpegComponent{{id: 1, table: 0}}
+	if !gray {
+		components = append(components, jpegComponent{id: 2, table: 1}, jpegComponent{id: 3, table: 1})
+	}
+
+	// 端のブロックは最後の行と列の画素を繰り返して埋める
+	bw, bh := (width+7)/8, (height+7)/8
+	for i := range components {
+		components[i].blocks = make([][64]int16, bw*bh)
+	}
+	var pixels [3][64]float64
+	for by := 0; by < bh; by++ {
+		for bx := 0; bx < bw; bx++ {
+			for j := 0; j < 64; j++ {
+				x, y := bx*8+j%8, by*8+j/8
+				if width <= x {
+					x = width - 1
+				}
+				if height <= y {
+					y = height - 1
+				}
+				r, g, b, _ := m.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+				pixels[0][j] = float64(yy) - 128
+				pixels[1][j] = float64(cb) - 128
+				pixels[2][j] = float64(cr) - 128
+			}
+			for i := range components {
+				components[i].blocks[by*bw+bx] = quantizeBlock(&pixels[i], &quants[components[i].table])
+			}
+		}
+	}
+
+	// DC をまとめて送り、輝度の低域、色差、輝度の高域の順に送る
+	scans := []jpegScan{{components: []int{0}, start: 0, end: 0}}
+	if gray {
+		scans = append(scans, jpegScan{[]int{0}, 1, 5}, jpegScan{[]int{0}, 6, 63})
+	} else {
+		scans[0].components = []int{0, 1, 2}
+		scans = append(scans,
+			jpegScan{[]int{0}, 1, 5},
+			jpegScan{[]int{1}, 1, 63},
+			jpegScan{[]int{2}, 1, 63},
+			jpegScan{[]int{0}, 6, 63},
+		)
+	}
+
+	bw2 := bufio.NewWriter(w)
+	bits := &jpegBitWriter{w: bw2}
+	bw2.Write([]byte{0xff, 0xd8})
+
+	// DQT
+	tables := 1
+	if !gray {
+		tables = 2
+	}
+	bw2.Write([]byte{0xff, 0xdb, 0x00, byte(2 + tables*65)})
+	for t := 0; t < tables; t++ {
+		bw2.WriteByte(byte(t))
+		for _, q := range quants[t] {
+			bw2.WriteByte(byte(q))
+		}
+	}
+
+	// SOF2
+	bw2.Write([]byte{0xff, 0xc2, 0x00, byte(8 + 3*len(components)), 8,
+		byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(len(components))})
+	for _, c := range components {
+		bw2.Write([]byte{c.id, 0x11, byte(c.table)})
+	}
+
+	// DHT
+	for i, spec := range jpegHuffmanSpecs[:2*tables] {
+		class, id := byte(i%2), byte(i/2)
+		bw2.Write([]byte{0xff, 0xc4, byte((3 + 16 + len(spec.values)) >> 8), byte(3 + 16 + len(spec.values)), class<<4 | id})
+		bw2.Write(spec.counts[:])
+		bw2.Write(spec.values)
+	}
+
+	for _, scan := range scans {
+		bw2.Write([]byte{0xff, 0xda, 0x00, byte(6 + 2*len(scan.components)), byte(len(scan.components))})
+		for _, ci := range scan.components {
+			c := components[ci]
+			bw2.Write([]byte{c.id, byte(c.table<<4 | c.table)})
+		}
+		bw2.Write([]byte{byte(scan.start), byte(scan.end), 0x00})
+
+		if scan.start == 0 {
+			// DC は直前のブロックとの差を送る
+			prev := make([]int32, len(components))
+			for b := 0; b < bw*bh; b++ {
+				for _, ci := range scan.components {
+					c := components[ci]
+					dc := int32(c.blocks[b][0])
+					bits.emitValue(c.table*2, 0, dc-prev[ci])
+					prev[ci] = dc
+				}
+			}
+		} else {
+			c := components[scan.components[0]]
+			ac := c.table*2 + 1
+			for b := 0; b < bw*bh; b++ {
+				run := 0
+				for k := scan.start; k <= scan.end; k++ {
+					v := int32(c.blocks[b][k])
+					if v == 0 {
+						run++
+						continue
+					}
+					for 15 < run {
+						bits.emitHuffman(ac, 0xf0)
+						run -= 16
+					}
+					bits.emitValue(ac, run, v)
+					run = 0
+				}
+				if 0 < run {
+					// EOB (このブロックの残りはすべて 0)
+					bits.emitHuffman(ac, 0x00)
+				}
+			}
+		}
+		bits.flush()
+	}
+
+	bw2.Write([]byte{0xff, 0xd9})
+	return bw2.Flush()
+}
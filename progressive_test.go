@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	imagepkg "image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+// gradientImage は滑らかな模様の画像を作る。写真に近く、JPEG で大きく崩れないもの。
+// 左上を (3, 5) にして、Bounds().Min が 0 でない画像も確かめる。
+func gradientImage(width, height int, gray bool) imagepkg.Image {
+	r := imagepkg.Rect(3, 5, 3+width, 5+height)
+	var m interface {
+		imagepkg.Image
+		Set(x, y int, c color.Color)
+	}
+	if gray {
+		m = imagepkg.NewGray(r)
+	} else {
+		m = imagepkg.NewRGBA(r)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			fx, fy := float64(x-r.Min.X)/float64(width), float64(y-r.Min.Y)/float64(height)
+			m.Set(x, y, color.RGBA{
+				R: uint8(40 + 170*fx),
+				G: uint8(40 + 170*fy),
+				B: uint8(128 + 80*math.Sin(3*(fx+fy))),
+				A: 255,
+			})
+		}
+	}
+	return m
+}
+
+// psnr は a と b の RGB の PSNR (dB) を返す。同じ画像なら +Inf。
+func psnr(a, b imagepkg.Image) float64 {
+	ab, bb := a.Bounds(), b.Bounds()
+	sum, n := 0.0, 0
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			r1, g1, b1, _ := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range []float64{
+				float64(r1>>8) - float64(r2>>8),
+				float64(g1>>8) - float64(g2>>8),
+				float64(b1>>8) - float64(b2>>8),
+			} {
+				sum += d * d
+				n++
+			}
+		}
+	}
+	if sum == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/(sum/float64(n)))
+}
+
+func TestEncodeProgressiveJpeg(t *testing.T) {
+	sizes := [][2]int{{1, 1}, {7, 9}, {33, 17}}
+	// quality 0 は 75 として扱われる
+	floors := map[int]float64{0: 30, 50: 28, 100: 40}
+	for _, gray := range []bool{false, true} {
+		for _, size := range sizes {
+			for _, quality := range []int{0, 50, 100} {
+				m := gradientImage(size[0], size[1], gray)
+				name := "rgba"
+				if gray {
+					name = "gray"
+				}
+				buf := new(bytes.Buffer)
+				if err := encodeProgressiveJpeg(buf, m, quality); err != nil {
+					t.Errorf("%s %dx%d q%d: %v", name, size[0], size[1], quality, err)
+					continue
+				}
+				data := buf.Bytes()
+				// SOF2 (progressive DCT) で書かれていること
+				if !bytes.Contains(data, []byte{0xff, 0xc2}) {
+					t.Errorf("%s %dx%d q%d: SOF2 marker not found", name, size[0], size[1], quality)
+				}
+				decoded, err := jpeg.Decode(bytes.NewReader(data))
+				if err != nil {
+					t.Errorf("%s %dx%d q%d: decode: %v", name, size[0], size[1], quality, err)
+					continue
+				}
+				if decoded.Bounds().Dx() != size[0] || decoded.Bounds().Dy() != size[1] {
+					t.Errorf("%s %dx%d q%d: decoded size %v", name, size[0], size[1], quality, decoded.Bounds())
+					continue
+				}
+				if _, ok := decoded.(*imagepkg.Gray); ok != gray {
+					t.Errorf("%s %dx%d q%d: decoded as %T", name, size[0], size[1], quality, decoded)
+				}
+				if p := psnr(m, decoded); p < floors[quality] {
+					t.Errorf("%s %dx%d q%d: PSNR %.1fdB, want at least %.0fdB", name, size[0], size[1], quality, p, floors[quality])
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeProgressiveJpegEmpty(t *testing.T) {
+	if err := encodeProgressiveJpeg(new(bytes.Buffer), imagepkg.NewRGBA(imagepkg.Rect(0, 0, 0, 4)), 75); err == nil {
+		t.Error("empty image was encoded")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultVariantUrlsPerMinute = 60
+
+// RateLimiter はユーザーごとに window の間に limit 回まで許す。
+// window ごとに数え直すだけの単純なもので、プロセスごとに数える。
+type RateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	counts map[int]int
+}
+
+var variantUrlLimiter *RateLimiter
+
+func newRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{limit: limit, window: window, start: time.Now(), counts: map[int]int{}}
+}
+
+// Allow は user が今の window で limit 回を超えていなければ数えて true を返す。
+func (l *RateLimiter) Allow(user int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); l.window <= now.Sub(l.start) {
+		l.start = now
+		l.counts = map[int]int{}
+	}
+	if l.limit <= l.counts[user] {
+		return false
+	}
+	l.counts[user]++
+	return true
+}
+
+// RetryAfter は今の window が終わるまでの秒数。
+func (l *RateLimiter) RetryAfter() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int((l.window-time.Since(l.start))/time.Second) + 1
+}
+
+// openVariantUrlLimiter は config から variantUrlLimiter を作る。
+func openVariantUrlLimiter(config *Config) {
+	limit := config.VariantUrlsPerMinute
+	if limit <= 0 {
+		limit = defaultVariantUrlsPerMinute
+	}
+	variantUrlLimiter = newRateLimiter(limit, time.Minute)
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter int) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	code := http.StatusTooManyRequests
+	http.Error(w, http.StatusText(code), code)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// renderCall は実行中の 1 回の生成。終わると done が閉じられる。
+type renderCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// RenderGroup は同じ key の生成をまとめ、最初の 1 つだけが実際に作り、
+// 残りはその結果を待つ。
+type RenderGroup struct {
+	mu    sync.Mutex
+	calls map[string]*renderCall
+}
+
+func newRenderGroup() *RenderGroup {
+	return &RenderGroup{calls: map[string]*renderCall{}}
+}
+
+// Do は key の生成が実行中ならその結果を待ち、なければ fn を実行する。
+func (g *RenderGroup) Do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.data, c.err
+	}
+	c := &renderCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.data, c.err = fn()
+	return c.data, c.err
+}
+
+var renders = newRenderGroup()
+
+// loadOrRender は variantCache か staticStore にある key の画像を返す。
+// 無ければ render を renderPool で実行して保存する。
+// 同じ key を同時に要求されても render は 1 回しか実行しない。
+// renderPool が一杯なら errPoolBusy を返す。
+func loadOrRender(vk VariantKey, render func() ([]byte, error)) ([]byte, error) {
+	if data, ok := variantCache.Get(vk); ok {
+		return data, nil
+	}
+	key := vk.Path()
+	data, err := staticStore.Get(key)
+	if err == nil {
+		log.Println("Load from", key)
+		variantCache.Add(vk, data)
+		return data, nil
+	} else if err != ErrBlobNotFound {
+		return nil, err
+	}
+	data, err = renderAndStore(vk, render)
+	if err != nil {
+		return nil, err
+	}
+	variantCache.Add(vk, data)
+	return data, nil
+}
+
+// renderAndStore は render を renderPool で実行して staticStore に保存する。
+// variantCache には入れない。同じ key の生成が実行中ならその結果を待つ。
+func renderAndStore(vk VariantKey, render func() ([]byte, error)) ([]byte, error) {
+	key := vk.Path()
+	return renders.Do(key, func() ([]byte, error) {
+		// 待っている間に別の生成が保存し終えているかもしれない
+		if data, err := staticStore.Get(key); err == nil {
+			return data, nil
+		}
+		data, err := renderPool.Do(render)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Save to", key)
+		if err := staticStore.Put(key, data); err != nil {
+			log.Println("Failed to write file", key)
+			return nil, err
+		}
+		return data, nil
+	})
+}
+
+// renderIcon はアイコンの原本から preset の大きさの画像を ext で作る。
+func renderIcon(icon string, preset Preset, ext string) ([]byte, error) {
+	original, err := dataStore.Get("icon/" + icon + ".png")
+	if err != nil {
+		return nil, err
+	}
+	return renderPreset(original, "png", preset, ext)
+}
+
+// renderImage は format 形式の原本から preset か variant の大きさの画像を ext で作る。
+// variant が nil でなければ preset より優先する。
+func renderImage(image string, format string, preset Preset, variant *Variant, ext string) ([]byte, error) {
+	original, err := dataStore.Get("image/" + image + "." + format)
+	if err != nil {
+		return nil, err
+	}
+	if variant == nil {
+		return renderPreset(original, format, preset, ext)
+	}
+	decoded, orientation, err := decodeOriented(original)
+	if err != nil {
+		return nil, err
+	}
+	return renderVariant(decoded, orientation, *variant, ext, EncodeOptions{})
+}
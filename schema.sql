@@ -0,0 +1,85 @@
+-- Tables and columns added on top of the original isucon3 final schema.
+
+-- user が target をブロックしている
+CREATE TABLE IF NOT EXISTS blocks (
+  user INT NOT NULL,
+  target INT NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (user, target),
+  KEY (target)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- GET /followers, /user/{id}/followers 用
+ALTER TABLE follow_map ADD INDEX target_created_at (target, created_at);
+
+-- user が target をミュートしている
+CREATE TABLE IF NOT EXISTS mutes (
+  user INT NOT NULL,
+  target INT NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (user, target)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- 非公開アカウント
+ALTER TABLE users ADD COLUMN private TINYINT(1) NOT NULL DEFAULT 0;
+
+-- 非公開アカウントへの承認待ちの follow
+CREATE TABLE IF NOT EXISTS follow_requests (
+  id INT NOT NULL AUTO_INCREMENT,
+  user INT NOT NULL,
+  target INT NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY (user, target),
+  KEY (target, created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- entry のキャプション
+ALTER TABLE entries ADD COLUMN caption VARCHAR(1000) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS likes (
+  entry INT NOT NULL,
+  user INT NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (entry, user)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- parent が 0 なら entry への直接のコメント
+CREATE TABLE IF NOT EXISTS comments (
+  id INT NOT NULL AUTO_INCREMENT,
+  entry INT NOT NULL,
+  user INT NOT NULL,
+  parent INT NOT NULL DEFAULT 0,
+  body VARCHAR(1000) NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (id),
+  KEY (entry, id),
+  KEY (parent)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- kind は follow, follow_request, like, comment のいずれか
+CREATE TABLE IF NOT EXISTS notifications (
+  id INT NOT NULL AUTO_INCREMENT,
+  user INT NOT NULL,
+  kind VARCHAR(32) NOT NULL,
+  actor INT NOT NULL,
+  entry INT NOT NULL DEFAULT 0,
+  comment INT NOT NULL DEFAULT 0,
+  is_read TINYINT(1) NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (id),
+  KEY (user, is_read),
+  KEY (entry)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- entry に含まれる画像。entries.image には先頭 (position = 0) の画像も入れる
+CREATE TABLE IF NOT EXISTS entry_images (
+  entry INT NOT NULL,
+  image VARCHAR(64) NOT NULL,
+  position INT NOT NULL,
+  PRIMARY KEY (entry, position),
+  UNIQUE KEY (image)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- 元画像の拡張子 (jpg, png, gif, webp)
+ALTER TABLE entry_images ADD COLUMN format VARCHAR(8) NOT NULL DEFAULT 'jpg';
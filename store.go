@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore は画像やアイコンの保存先を抽象化する。
+// key は "image/xxx.jpg" や "icon/s/xxx.png" のような "/" 区切りのパス。
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Stat(key string) (BlobInfo, error)
+	Delete(key string) error
+	List(prefix string) ([]string, error)
+}
+
+func newBlobStore(kind string, root string) BlobStore {
+	if kind == "memory" {
+		return newMemoryStore()
+	}
+	return newFileStore(root)
+}
+
+type fileStore struct {
+	root string
+}
+
+func newFileStore(root string) *fileStore {
+	return &fileStore{root: root}
+}
+
+func (s *fileStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// Put は一時ファイルに書いてから rename するので、読み手が書きかけのファイルを見ることはない。
+func (s *fileStore) Put(key string, data []byte) error {
+	filename := s.path(key)
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// TempFile は 0600 で作るので nginx からも読めるようにする
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *fileStore) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (s *fileStore) Stat(key string) (BlobInfo, error) {
+	fi, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrBlobNotFound
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *fileStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+// List は prefix 直下のファイルの key を返す。サブディレクトリは辿らない。
+func (s *fileStore) List(prefix string) ([]string, error) {
+	dir := strings.TrimSuffix(prefix, "/")
+	infos, err := ioutil.ReadDir(s.path(dir))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, fi := range infos {
+		// "." で始まるのは Put の書きかけの一時ファイル
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if dir == "" {
+			keys = append(keys, fi.Name())
+		} else {
+			keys = append(keys, dir+"/"+fi.Name())
+		}
+	}
+	return keys, nil
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+type memoryStore struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{blobs: map[string]memoryBlob{}}
+}
+
+func (s *memoryStore) Put(key string, data []byte) error {
+	b := make([]byte, len(data))
+	copy(b, data)
+	s.mu.Lock()
+	s.blobs[key] = memoryBlob{data: b, modTime: time.Now()}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	blob, ok := s.blobs[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return blob.data, nil
+}
+
+func (s *memoryStore) Stat(key string) (BlobInfo, error) {
+	s.mu.RLock()
+	blob, ok := s.blobs[key]
+	s.mu.RUnlock()
+	if !ok {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	return BlobInfo{Key: key, Size: int64(len(blob.data)), ModTime: blob.modTime}, nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[key]; !ok {
+		return ErrBlobNotFound
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+// List は fileStore と同じく prefix 直下の key だけを返す。
+func (s *memoryStore) List(prefix string) ([]string, error) {
+	dir := strings.TrimSuffix(prefix, "/")
+	if dir != "" {
+		dir += "/"
+	}
+	keys := []string{}
+	s.mu.RLock()
+	for key := range s.blobs {
+		if strings.HasPrefix(key, dir) && !strings.Contains(key[len(dir):], "/") {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const keepAliveInterval = 15
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// streamTimeline は user に見える entry が publish されるたびに send を呼ぶ。
+// done が閉じられるか send がエラーを返すまで戻らない。
+func streamTimeline(user *User, baseUrl *url.URL, done <-chan struct{}, send func(ev Event, res Response) error, ping func() error) error {
+	sub := timelineHub.Subscribe()
+	defer sub.Close()
+
+	ticker := time.NewTicker(time.Second * keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return err
+			}
+		case ev := <-sub.C:
+			ok, err := visibleOnTimeline(user, ev.Entry)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			owner, err := getUserById(ev.Entry.User)
+			if err != nil {
+				return err
+			}
+			res, err := entryResponse(baseUrl, ev.Entry, owner, user)
+			if err != nil {
+				return err
+			}
+			if err := send(ev, res); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func timelineStreamHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		serverError(w, errors.New("streaming unsupported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err = streamTimeline(user, baseUrl, r.Context().Done(),
+		func(ev Event, res Response) error {
+			_, err := fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", ev.Type, ev.Entry.Id, res)
+			flusher.Flush()
+			return err
+		},
+		func() error {
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+			return err
+		},
+	)
+	if err != nil {
+		log.Println("timeline stream closed:", err)
+	}
+}
+
+func timelineWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("websocket upgrade failed:", err)
+		return
+	}
+	defer conn.Close()
+
+	// クライアントからのメッセージは読み捨てて、切断の検知にだけ使う
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = streamTimeline(user, baseUrl, done,
+		func(ev Event, res Response) error {
+			return conn.WriteJSON(Response{"type": ev.Type, "entry": res})
+		},
+		func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second*keepAliveInterval))
+		},
+	)
+	if err != nil {
+		log.Println("timeline websocket closed:", err)
+	}
+}
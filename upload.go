@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	imagepkg "image"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+)
+
+const (
+	maxUploadBytes     = 10 << 20
+	maxImageDimension  = 8000
+	maxUploadOverhead  = 1 << 20
+	multipartMemoryMax = 32 << 20
+)
+
+// UploadError はアップロードされた画像を受け付けなかった理由。
+// Code は 400 か 413 で、Reason はクライアントが分岐に使う短い識別子。
+type UploadError struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *UploadError) Error() string {
+	return e.Reason + ": " + e.Message
+}
+
+func renderUploadError(w http.ResponseWriter, e *UploadError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Code)
+	fmt.Fprint(w, Response{"error": e.Reason, "message": e.Message})
+}
+
+// limitUploadBody はリクエスト全体の大きさを n 枚分の画像に制限する。
+func limitUploadBody(w http.ResponseWriter, r *http.Request, n int) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(n)*maxUploadBytes+maxUploadOverhead)
+}
+
+// parseUploadForm は multipart を読み、大きすぎるときは 413 の UploadError を返す。
+func parseUploadForm(r *http.Request) *UploadError {
+	err := r.ParseMultipartForm(multipartMemoryMax)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*http.MaxBytesError); ok {
+		return &UploadError{http.StatusRequestEntityTooLarge, "request_too_large", "request body is too large"}
+	}
+	return &UploadError{http.StatusBadRequest, "invalid_form", err.Error()}
+}
+
+// sniffImage は先頭のマジックバイトから画像の拡張子を判定する。
+// multipart の Content-Type はクライアントが自由に付けられるので信用しない。
+func sniffImage(data []byte) (string, bool) {
+	if bytes.HasPrefix(data, []byte("\xff\xd8\xff")) {
+		return "jpg", true
+	}
+	if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return "png", true
+	}
+	if bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a")) {
+		return "gif", true
+	}
+	if 12 <= len(data) && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")) {
+		return "webp", true
+	}
+	return "", false
+}
+
+// readUpload はアップロードされたファイルを maxUploadBytes まで読み、
+// 中身を検査して拡張子とデコードした画像を返す。allowed に無い形式は拒否する。
+// 画像には Exif の向きを反映していない (必要なら縮小してから applyOrientation する)。
+func readUpload(handler *multipart.FileHeader, allowed ...string) ([]byte, string, imagepkg.Image, error) {
+	if maxUploadBytes < handler.Size {
+		return nil, "", nil, &UploadError{http.StatusRequestEntityTooLarge, "image_too_large", fmt.Sprintf("image must be at most %d bytes", maxUploadBytes)}
+	}
+	file, err := handler.Open()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxUploadBytes+1))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if maxUploadBytes < len(data) {
+		return nil, "", nil, &UploadError{http.StatusRequestEntityTooLarge, "image_too_large", fmt.Sprintf("image must be at most %d bytes", maxUploadBytes)}
+	}
+
+	ext, ok := sniffImage(data)
+	if !ok {
+		return nil, "", nil, &UploadError{http.StatusBadRequest, "unsupported_format", "image must be one of jpeg, png, gif or webp"}
+	}
+	allowedExt := false
+	for _, a := range allowed {
+		if a == ext {
+			allowedExt = true
+		}
+	}
+	if !allowedExt {
+		return nil, "", nil, &UploadError{http.StatusBadRequest, "unsupported_format", ext + " is not accepted here"}
+	}
+
+	// デコード前に大きさを確かめて、巨大な画像でメモリを使い切らないようにする
+	header, format, err := imagepkg.DecodeConfig(bytes.NewReader(data))
+	if err != nil || decoderExts[format] != ext {
+		return nil, "", nil, &UploadError{http.StatusBadRequest, "invalid_image", "image could not be decoded"}
+	}
+	if header.Width <= 0 || header.Height <= 0 || maxImageDimension < header.Width || maxImageDimension < header.Height {
+		return nil, "", nil, &UploadError{http.StatusRequestEntityTooLarge, "image_too_large", fmt.Sprintf("image must be at most %dx%d pixels", maxImageDimension, maxImageDimension)}
+	}
+
+	// デコードは重いので renderPool で行う。一杯なら errPoolBusy を返す
+	var image imagepkg.Image
+	var decodeErr error
+	_, err = renderPool.Do(func() ([]byte, error) {
+		image, _, decodeErr = imagepkg.Decode(bytes.NewReader(data))
+		return nil, nil
+	})
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if decodeErr != nil {
+		return nil, "", nil, &UploadError{http.StatusBadRequest, "invalid_image", "image could not be decoded"}
+	}
+	return data, ext, image, nil
+}
+
+// uploadFailed は readUpload のエラーを適切なレスポンスにする。
+// renderPool が混んでいれば renderFailed と同じく 503 にする。
+func uploadFailed(w http.ResponseWriter, err error) {
+	if e, ok := err.(*UploadError); ok {
+		renderUploadError(w, e)
+		return
+	}
+	renderFailed(w, err)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	imagepkg "image"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/nfnt/resize"
+	"github.com/oliamb/cutter"
+)
+
+const maxVariantDimension = 2048
+
+// variantUrlHandler は幅と高さをこの倍数に切り上げてから署名する。
+// 1 枚の画像について作られうる大きさの数を抑え、static_dir と CPU を使い切られないようにする。
+const variantGrid = 64
+
+var (
+	errInvalidVariant   = errors.New("invalid variant")
+	errVariantSignature = errors.New("invalid variant signature")
+)
+
+// Variant は w, h, fit で指定された任意の大きさの画像。
+// cover は切り抜いてちょうど Width x Height に、contain は縦横比を保って収まる大きさにする。
+type Variant struct {
+	Width  int
+	Height int
+	Fit    string
+}
+
+// Name は static_dir に保存するときのディレクトリ名。
+func (v Variant) Name() string {
+	return fmt.Sprintf("%dx%d-%s", v.Width, v.Height, v.Fit)
+}
+
+// signVariant は image の v を要求するための署名を返す。
+func signVariant(image string, v Variant) string {
+	mac := hmac.New(sha256.New, []byte(config.ImageSecret))
+	mac.Write([]byte(image + ":" + v.Name()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// snapVariant は v の幅と高さを variantGrid の倍数に切り上げる。
+func snapVariant(v Variant) Variant {
+	v.Width = (v.Width + variantGrid - 1) / variantGrid * variantGrid
+	v.Height = (v.Height + variantGrid - 1) / variantGrid * variantGrid
+	return v
+}
+
+// variantUrl は image の v を要求する署名付きの URL を返す。
+func variantUrl(baseUrl *url.URL, image string, v Variant) string {
+	q := url.Values{}
+	q.Set("w", strconv.Itoa(v.Width))
+	q.Set("h", strconv.Itoa(v.Height))
+	q.Set("fit", v.Fit)
+	q.Set("sig", signVariant(image, v))
+	return baseUrl.String() + "/image/" + image + "?" + q.Encode()
+}
+
+// parseVariant は w, h, fit, sig パラメータを読む。w も h も無ければ nil を返す。
+// 署名が無いか合わなければ errVariantSignature を返す。
+func parseVariant(r *http.Request, image string) (*Variant, error) {
+	if r.FormValue("w") == "" && r.FormValue("h") == "" {
+		return nil, nil
+	}
+	if config.ImageSecret == "" {
+		return nil, errVariantSignature
+	}
+	v, err := parseVariantSize(r)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := hex.DecodeString(r.FormValue("sig"))
+	if err != nil {
+		return nil, errVariantSignature
+	}
+	expected, _ := hex.DecodeString(signVariant(image, *v))
+	if !hmac.Equal(sig, expected) {
+		return nil, errVariantSignature
+	}
+	return v, nil
+}
+
+// parseVariantSize は署名を見ずに w, h, fit パラメータを読む。
+func parseVariantSize(r *http.Request) (*Variant, error) {
+	width, err := strconv.Atoi(r.FormValue("w"))
+	if err != nil || width <= 0 || maxVariantDimension < width {
+		return nil, errInvalidVariant
+	}
+	height, err := strconv.Atoi(r.FormValue("h"))
+	if err != nil || height <= 0 || maxVariantDimension < height {
+		return nil, errInvalidVariant
+	}
+	fit := r.FormValue("fit")
+	if fit == "" {
+		fit = "cover"
+	}
+	if !(fit == "cover" || fit == "contain") {
+		return nil, errInvalidVariant
+	}
+
+	return &Variant{Width: width, Height: height, Fit: fit}, nil
+}
+
+// variantUrlHandler は閲覧できる画像について、w, h, fit で指定された大きさを
+// variantGrid の倍数に切り上げた署名付き URL を発行する。
+// 署名はログインしているユーザーにだけ、variantUrlLimiter の回数まで渡す。
+func variantUrlHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl := prepareHandler(w, r)
+
+	user, err := getUser(r)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if user == nil {
+		badRequest(w)
+		return
+	}
+	if config.ImageSecret == "" {
+		notFound(w)
+		return
+	}
+
+	image := mux.Vars(r)["image"]
+	entry, err := getEntryByImage(image)
+	if err == sql.ErrNoRows {
+		notFound(w)
+		return
+	} else if err != nil {
+		serverError(w, err)
+		return
+	}
+	if ok, err := policy.CanView(user, entry); err != nil {
+		serverError(w, err)
+		return
+	} else if !ok {
+		notFound(w)
+		return
+	}
+
+	v, err := parseVariantSize(r)
+	if err != nil {
+		badRequest(w)
+		return
+	}
+	if !variantUrlLimiter.Allow(user.Id) {
+		tooManyRequests(w, variantUrlLimiter.RetryAfter())
+		return
+	}
+	*v = snapVariant(*v)
+	renderJson(w, Response{
+		"url":    variantUrl(baseUrl, image, *v),
+		"width":  v.Width,
+		"height": v.Height,
+		"fit":    v.Fit,
+	})
+}
+
+// renderVariant は向きを反映していない image を v の大きさにして ext でエンコードする。
+// 切り抜きと縮小を先に済ませ、小さくなった画像に orientation を反映してから一度だけエンコードする。
+func renderVariant(image imagepkg.Image, orientation int, v Variant, ext string, options EncodeOptions) ([]byte, error) {
+	// 縦横が入れ替わる向きなら、回す前の画像では幅と高さが逆になる
+	if swapsAxes(orientation) {
+		v.Width, v.Height = v.Height, v.Width
+	}
+	resized, err := fitVariant(image, v)
+	if err != nil {
+		return nil, err
+	}
+	return encodeImage(applyOrientation(resized, orientation), ext, options)
+}
+
+// fitVariant は image を v の大きさに切り抜いて縮小する。
+func fitVariant(image imagepkg.Image, v Variant) (imagepkg.Image, error) {
+	if v.Fit == "contain" {
+		return resize.Thumbnail(uint(v.Width), uint(v.Height), image, resize.Lanczos3), nil
+	}
+
+	// 中央を v と同じ縦横比で切り抜いてから縮小する
+	w := image.Bounds().Dx()
+	h := image.Bounds().Dy()
+	cropW, cropH := w, h
+	if w*v.Height > h*v.Width {
+		cropW = h * v.Width / v.Height
+	} else {
+		cropH = w * v.Height / v.Width
+	}
+	if cropW < 1 {
+		cropW = 1
+	}
+	if cropH < 1 {
+		cropH = 1
+	}
+	cropped, err := cutter.Crop(image, cutter.Config{Width: cropW, Height: cropH, Mode: cutter.Centered})
+	if err != nil {
+		return nil, err
+	}
+	return resize.Resize(uint(v.Width), uint(v.Height), cropped, resize.Lanczos3), nil
+}